@@ -4,16 +4,27 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 	"unsafe"
 )
 
@@ -45,147 +56,397 @@ func termSize() (w, h int) {
 type panel struct {
 	title   string
 	color   string
-	r0, c0  int             // top-left of content area (1-indexed)
-	w, h    int             // content dimensions
-	cr, cc  int             // draw cursor within content (0-indexed)
-	lines   []string        // committed lines (used for scrolling)
-	curLine strings.Builder // line currently being written
-	buf     strings.Builder // full raw text (for full-screen view)
+	r0, c0  int                // top-left of content area (1-indexed)
+	w, h    int                // content dimensions
+	cr, cc  int                // draw cursor within content (0-indexed)
+	lines   []string           // committed lines (used for scrolling)
+	clipped []bool             // per committed line: it ran past the panel width
+	curLine strings.Builder    // line currently being written
+	buf     strings.Builder    // full raw text (for full-screen view)
+	partial string             // incomplete UTF-8 tail held back from the last write
+	squeeze blankSqueezer      // --compact state
+	gutter  string             // drawn at the start of each written line (boxed sections)
+	cancel  context.CancelFunc // stops just this panel's requests
+	tokens  int                // output tokens so far, shown on the status row
+	exact   bool               // tokens is a reported count, not an estimate
+	base    int                // tokens from earlier requests of this panel
+	config  panelConfig        // per-panel request overrides
+	reply   string             // the latest complete model response (checked by --expected)
+	correct bool               // reply matched --expected
+	err     error              // the panel's first failed request, not counting cancellations
+	alive   bool               // heartbeats arrived but no tokens yet; shown on the status row
+	stopped bool               // the last run was cancelled (Ctrl+C or the panel's key)
+}
+
+// panelConfig overrides the shared config for a single panel; zero fields inherit.
+type panelConfig struct {
+	model       string
+	maxTokens   int
+	temperature *float64
+}
+
+func (pc panelConfig) apply(cfg config) config {
+	if pc.model != "" {
+		cfg.model = pc.model
+	}
+	if pc.maxTokens > 0 {
+		cfg.maxTokens = pc.maxTokens
+	}
+	if pc.temperature != nil {
+		cfg.temperature = *pc.temperature
+	}
+	return cfg
 }
 
 // ─── Split screen ─────────────────────────────────────────────────────────────
 
 type splitScreen struct {
-	mu         sync.Mutex
-	panels     [4]*panel
-	panelCount int
-	termW      int
-	half       int
-	panelH     int
-	midRow     int
-	questR     int
-	sepR       int
-	statusR    int
-	question   string
-	doneCount  int
+	mu        sync.Mutex
+	panels    []*panel
+	termW     int
+	questR    int
+	sepR      int
+	statusR   int
+	question  string
+	english   bool // UI strings in English (the model comparison)
+	doneCount int
+	bell      string       // alert mode used once every panel is done
+	lineNums  bool         // full-screen view shows a line-number gutter
+	expect    *expectation // --expected answer, nil when not judging
+	failFast  bool         // the first failed panel cancels the others
+	failed    *panel       // the panel that stopped the rest under failFast
+
+	// jobs[i] is panel i's work, kept so failed panels can be retried.
+	jobs []func(ctx context.Context)
 }
 
 func newSplitScreen(question string) *splitScreen {
+	return newGridScreen(question, false,
+		"1. Direct", "2. Step-by-step", "3. Meta-prompting", "4. Expert panel", "5. Self-consistency")
+}
+
+// techniqueCount is the number of panels newSplitScreen lays out.
+const techniqueCount = 5
+
+// panelItems splits a --panel-* list into its trimmed items, one for each
+// technique panel in order. An empty item leaves its panel on the shared
+// setting.
+func panelItems(name, s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	items := strings.Split(s, ",")
+	if len(items) > techniqueCount {
+		return nil, fmt.Errorf("%s: at most %d values, got %d", name, techniqueCount, len(items))
+	}
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+	return items, nil
+}
+
+// parsePanelTokens reads --panel-tokens: max tokens for the technique panels
+// in order, 0 where an item is empty.
+func parsePanelTokens(s string) ([]int, error) {
+	items, err := panelItems("--panel-tokens", s)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []int
+	for _, item := range items {
+		n := 0
+		if item != "" {
+			if n, err = strconv.Atoi(item); err != nil || n < 1 {
+				return nil, fmt.Errorf("--panel-tokens: %q is not a positive token count", item)
+			}
+		}
+		tokens = append(tokens, n)
+	}
+	return tokens, nil
+}
+
+// techniqueConfigs builds the technique panels' overrides from --panel-tokens,
+// --panel-models and --panel-temps. The expert panel speaks for three people,
+// so unless --panel-tokens says otherwise it gets twice --max-tokens.
+func techniqueConfigs(cfg config) ([techniqueCount]panelConfig, error) {
+	var pcs [techniqueCount]panelConfig
+	pcs[3].maxTokens = 2 * cfg.maxTokens
+
+	tokens, err := parsePanelTokens(cfg.panelTokens)
+	if err != nil {
+		return pcs, err
+	}
+	for i, n := range tokens {
+		if n > 0 {
+			pcs[i].maxTokens = n
+		}
+	}
+
+	models, err := panelItems("--panel-models", cfg.panelModels)
+	if err != nil {
+		return pcs, err
+	}
+	for i, name := range models {
+		if name == "" {
+			continue
+		}
+		model, ok := anthropicModel(name)
+		if !ok {
+			return pcs, fmt.Errorf("--panel-models: %q is not an Anthropic model", name)
+		}
+		pcs[i].model = model
+	}
+
+	temps, err := panelItems("--panel-temps", cfg.panelTemps)
+	if err != nil {
+		return pcs, err
+	}
+	for i, item := range temps {
+		if item == "" {
+			continue
+		}
+		t, err := strconv.ParseFloat(item, 64)
+		if err != nil || t < 0 || t > 1 {
+			return pcs, fmt.Errorf("--panel-temps: %q is not a temperature from 0 to 1", item)
+		}
+		pcs[i].temperature = &t
+	}
+	return pcs, nil
+}
+
+// newGridScreen lays the panels out in one row of up to three, or in two
+// rows with the extra panel on top, and draws the empty screen.
+func newGridScreen(question string, english bool, titles ...string) *splitScreen {
 	w, h := termSize()
-	half := w / 2
-
-	// Layout rows (1-indexed):
-	//   1            top border
-	//   2..pH+1      top panel content    (panelH rows)
-	//   pH+2         mid border
-	//   pH+3..2pH+2  bottom panel content (panelH rows)
-	//   2pH+3        bottom border
-	//   2pH+4        question line 1
-	//   2pH+5        question line 2
-	//   2pH+6        thin separator
-	//   2pH+7        status
-	// => panelH = (h - 7) / 2
-	panelH := (h - 7) / 2
-	if panelH < 3 {
-		panelH = 3
-	}
-	midRow  := panelH + 2
-	questR  := 2*panelH + 4
-	sepR    := 2*panelH + 6
-	statusR := 2*panelH + 7
-
-	panels := [4]*panel{
-		{title: "1. Direct",         color: "\033[94m", r0: 2,          c0: 2,        w: half - 1,     h: panelH},
-		{title: "2. Step-by-step",   color: "\033[92m", r0: 2,          c0: half + 2, w: w - half - 2, h: panelH},
-		{title: "3. Meta-prompting", color: "\033[93m", r0: midRow + 1, c0: 2,        w: half - 1,     h: panelH},
-		{title: "4. Expert panel",   color: "\033[95m", r0: midRow + 1, c0: half + 2, w: w - half - 2, h: panelH},
+	rows := 1
+	if len(titles) > 3 {
+		rows = 2
+	}
+
+	// Layout rows (1-indexed), for each of the panel rows:
+	//   border, then panelH content rows
+	// and below them:
+	//   bottom border, question (2 lines), thin separator, status
+	// => h = rows*(panelH+1) + 5
+	panelH := max((h-5)/rows-1, 3)
+	questR := rows*(panelH+1) + 2
+	sepR := questR + 2
+	statusR := questR + 3
+
+	var panels []*panel
+	perRow := (len(titles) + rows - 1) / rows
+	for i, title := range titles {
+		row, col := i/perRow, i%perRow
+		n := min(perRow, len(titles)-row*perRow) // panels in this row
+		left, right := col*(w/n)+1, (col+1)*(w/n)+1
+		if col == n-1 {
+			right = w
+		}
+		panels = append(panels, &panel{
+			title: title, color: activeTheme.panels[i],
+			r0: 2 + row*(panelH+1), c0: left + 1, w: right - left - 1, h: panelH,
+		})
 	}
 
 	ss := &splitScreen{
-		panels: panels, panelCount: 4, termW: w, half: half, panelH: panelH,
-		midRow: midRow, questR: questR, sepR: sepR, statusR: statusR,
-		question: question,
+		panels: panels, termW: w,
+		questR: questR, sepR: sepR, statusR: statusR,
+		question: question, english: english,
 	}
 
 	fmt.Print("\033[2J\033[H\033[?25l")
-	ss.drawBorders()
+	ss.drawFrame()
 
 	ss.drawQuestion()
 	fmt.Printf("\033[%d;1H%s", sepR, strings.Repeat("─", w))
-	fmt.Printf("\033[%d;1HStreaming... (Ctrl+C — отменить)", statusR)
+	fmt.Printf("\033[%d;1H%s", statusR, ss.text(
+		fmt.Sprintf("Streaming... (Ctrl+C — отменить всё, 1-%d — одну панель)", len(panels)),
+		fmt.Sprintf("Streaming from %d models... (Ctrl+C cancels all, 1-%d one panel)", len(panels), len(panels))))
 
 	return ss
 }
 
-func (ss *splitScreen) drawBorders() {
-	w, half, panelH, midRow := ss.termW, ss.half, ss.panelH, ss.midRow
-	hL := strings.Repeat("─", half-1)
-	hR := strings.Repeat("─", w-half-2)
+// frameGlyphs maps the border edges leaving a cell (up, down, left, right
+// as bits 3..0) to its box-drawing rune.
+var frameGlyphs = []rune(" ───│┌┐┬│└┘┴│├┤┼")
 
-	fmt.Printf("\033[1;1H┌%s┬%s┐", hL, hR)
-	for r := 2; r <= panelH+1; r++ {
-		fmt.Printf("\033[%d;1H│\033[%d;%dH│\033[%d;%dH│", r, r, half+1, r, w)
+// drawFrame draws every panel's box and titles. Shared edges merge, so any
+// grid gets the right corners and junctions.
+func (ss *splitScreen) drawFrame() {
+	bottom := 0
+	for _, p := range ss.panels {
+		bottom = max(bottom, p.r0+p.h)
 	}
-	fmt.Printf("\033[%d;1H├%s┼%s┤", midRow, hL, hR)
-	for r := midRow + 1; r <= midRow+panelH; r++ {
-		fmt.Printf("\033[%d;1H│\033[%d;%dH│\033[%d;%dH│", r, r, half+1, r, w)
+	edge := make([][]bool, bottom+2)
+	for r := range edge {
+		edge[r] = make([]bool, ss.termW+2)
+	}
+	for _, p := range ss.panels {
+		top, bot, left, right := p.r0-1, p.r0+p.h, p.c0-1, p.c0+p.w
+		for c := left; c <= right; c++ {
+			edge[top][c], edge[bot][c] = true, true
+		}
+		for r := top; r <= bot; r++ {
+			edge[r][left], edge[r][right] = true, true
+		}
 	}
-	fmt.Printf("\033[%d;1H└%s┴%s┘", midRow+panelH+1, hL, hR)
 
-	titleRows := [2]int{1, midRow}
-	titleCols := [2]int{3, half + 3}
-	for i, p := range ss.panels {
-		fmt.Printf("\033[%d;%dH%s %s \033[0m", titleRows[i/2], titleCols[i%2], p.color, p.title)
+	var out strings.Builder
+	for r := 1; r <= bottom; r++ {
+		for c := 1; c <= ss.termW; c++ {
+			if !edge[r][c] {
+				continue
+			}
+			bits := 0
+			for i, on := range []bool{edge[r-1][c], edge[r+1][c], edge[r][c-1], edge[r][c+1]} {
+				if on {
+					bits |= 8 >> i
+				}
+			}
+			if c == 1 || !edge[r][c-1] {
+				fmt.Fprintf(&out, "\033[%d;%dH", r, c)
+			}
+			out.WriteRune(frameGlyphs[bits])
+		}
+	}
+	for _, p := range ss.panels {
+		drawTitle(p, &out)
+	}
+	fmt.Print(out.String())
+}
+
+func drawTitle(p *panel, out *strings.Builder) {
+	title := p.shownTitle()
+	for _, mark := range []string{markFailed, markCancelled} {
+		title = strings.Replace(title, mark, styledMark(mark)+p.color, 1)
 	}
+	fmt.Fprintf(out, "\033[%d;%dH%s %s \033[0m", p.r0-1, p.c0+1, p.color, title)
+}
+
+// shownTitle is the title cut to fit the top edge of the frame.
+func (p *panel) shownTitle() string {
+	return ellipsize(p.title, p.w-2)
 }
 
 // drawQuestion renders the question across up to 2 lines in the question area.
+// All widths come from ss.termW and the label, so it is safe to call again
+// after the layout changes.
 func (ss *splitScreen) drawQuestion() {
-	const prefix = "Вопрос: "
-	prefixW := len([]rune(prefix))
-	qRunes := []rune(ss.question)
-	w := ss.termW
+	w := max(ss.termW, 0)
+	// On a terminal narrower than the label even the label is cut, and the
+	// question gets no room rather than overrunning the line.
+	prefix := ellipsize(ss.label(), w)
+	prefixW := stringWidth(prefix)
 	blank := strings.Repeat(" ", w)
 	fmt.Printf("\033[%d;1H%s", ss.questR, blank)
 	fmt.Printf("\033[%d;1H%s", ss.questR+1, blank)
-	line1Cap := w - prefixW
-	if len(qRunes) <= line1Cap {
-		fmt.Printf("\033[%d;1H%s%s", ss.questR, prefix, ss.question)
-	} else {
-		fmt.Printf("\033[%d;1H%s%s", ss.questR, prefix, string(qRunes[:line1Cap]))
-		rest := qRunes[line1Cap:]
+	lineCap := w - prefixW
+	line1, rest := cutWidth(ss.question, lineCap)
+	fmt.Printf("\033[%d;1H%s%s", ss.questR, prefix, line1)
+	if rest != "" {
 		indent := strings.Repeat(" ", prefixW)
-		line2Cap := w - prefixW
-		if len(rest) > line2Cap {
-			rest = append(rest[:line2Cap-3], '.', '.', '.')
+		fmt.Printf("\033[%d;1H%s%s", ss.questR+1, indent, ellipsize(rest, lineCap))
+	}
+}
+
+func (ss *splitScreen) label() string {
+	return ss.text("Вопрос: ", "Question: ")
+}
+
+// text picks the string for the screen's UI language.
+func (ss *splitScreen) text(ru, en string) string {
+	if ss.english {
+		return en
+	}
+	return ru
+}
+
+// ellipsize cuts s to at most w cells, ending in "..." when it was cut.
+func ellipsize(s string, w int) string {
+	if stringWidth(s) <= w {
+		return s
+	}
+	if w < 3 {
+		head, _ := cutWidth(s, max(w, 0))
+		return head
+	}
+	head, _ := cutWidth(s, w-3)
+	return head + "..."
+}
+
+// cutWidth splits s after as many runes as fit in w cells.
+func cutWidth(s string, w int) (head, rest string) {
+	col := 0
+	for i, r := range s {
+		if col += runeWidth(r); col > w {
+			return s[:i], s[i:]
 		}
-		fmt.Printf("\033[%d;1H%s%s", ss.questR+1, indent, string(rest))
 	}
+	return s, ""
 }
 
 // writeInto is the core write logic. Caller must hold mu (or be single-threaded).
 func (ss *splitScreen) writeInto(p *panel, text string, out *strings.Builder) {
+	text = escapeControls(text)
 	p.buf.WriteString(text)
 	for _, ch := range text {
 		switch ch {
 		case '\r':
 			// skip
 		case '\n':
-			ss.commitLine(p, out)
+			ss.commitLine(p, out, false)
+		case '\t':
+			// Pad to the next tab stop, or to the end of the row.
+			stop := tabWidth(renderOpts.tabStop)
+			n := min(stop-p.cc%stop, p.w-p.cc)
+			if n > 0 {
+				p.curLine.WriteString(strings.Repeat(" ", n))
+				fmt.Fprintf(out, "\033[%d;%dH%s", p.r0+p.cr, p.c0+p.cc, strings.Repeat(" ", n))
+				p.cc += n
+			}
 		default:
+			w := runeWidth(ch)
+			if p.cc+w > p.w {
+				ss.clipLine(p, out)
+			}
 			p.curLine.WriteRune(ch)
 			fmt.Fprintf(out, "\033[%d;%dH%c", p.r0+p.cr, p.c0+p.cc, ch)
-			p.cc++
-			if p.cc >= p.w {
-				ss.commitLine(p, out)
-			}
+			p.cc += w
 		}
 	}
 }
 
+// clipLine ends a row that the next rune no longer fits in, with a clip
+// marker in its last cell. A full row trades its last character (with any
+// combining marks) for the marker and carries it over to the next row; a
+// row with a cell to spare, too narrow for a wide rune, takes it there.
+func (ss *splitScreen) clipLine(p *panel, out *strings.Builder) {
+	if p.cc < p.w {
+		fmt.Fprintf(out, "\033[%d;%dH\033[2m›\033[0m", p.r0+p.cr, p.c0+p.w-1)
+		ss.commitLine(p, out, true)
+		return
+	}
+	runes := []rune(p.curLine.String())
+	cut := len(runes) - 1
+	for cut > 0 && runeWidth(runes[cut]) == 0 {
+		cut--
+	}
+	carry := string(runes[cut:])
+	cw := stringWidth(carry)
+	p.curLine.Reset()
+	p.curLine.WriteString(string(runes[:cut]))
+	fmt.Fprintf(out, "\033[%d;%dH\033[2m›\033[0m%s", p.r0+p.cr, p.c0+p.cc-cw, strings.Repeat(" ", cw-1))
+	ss.commitLine(p, out, true)
+	p.curLine.WriteString(carry)
+	fmt.Fprintf(out, "\033[%d;%dH%s", p.r0+p.cr, p.c0, carry)
+	p.cc = cw
+}
+
 // commitLine moves curLine into p.lines and advances or scrolls the panel.
-func (ss *splitScreen) commitLine(p *panel, out *strings.Builder) {
+// clipped marks a line cut at the panel width.
+func (ss *splitScreen) commitLine(p *panel, out *strings.Builder, clipped bool) {
 	p.lines = append(p.lines, p.curLine.String())
+	p.clipped = append(p.clipped, clipped)
 	p.curLine.Reset()
 	if len(p.lines) < p.h {
 		// Fast path: still within panel height.
@@ -204,16 +465,51 @@ func (ss *splitScreen) commitLine(p *panel, out *strings.Builder) {
 				runes = runes[:p.w]
 			}
 			fmt.Fprintf(out, "\033[%d;%dH%s", p.r0+i, p.c0, string(runes))
+			if p.clipped[start+i] {
+				fmt.Fprintf(out, "\033[%d;%dH\033[2m›\033[0m", p.r0+i, p.c0+p.w-1)
+			}
 		}
 		p.cr = p.h - 1
 		p.cc = 0
 	}
 }
 
+// indent puts the panel's gutter in front of every line text starts. The
+// gutter goes into buf too, so redraws and the full view keep the box.
+func (p *panel) indent(text string) string {
+	written := p.buf.String()
+	atStart := written == "" || strings.HasSuffix(written, "\n")
+	var b strings.Builder
+	for _, ch := range text {
+		if atStart && ch == '\n' {
+			b.WriteString(strings.TrimRight(p.gutter, " "))
+		} else if atStart {
+			b.WriteString(p.gutter)
+		}
+		b.WriteRune(ch)
+		atStart = ch == '\n'
+	}
+	return b.String()
+}
+
+// setGutter starts (or with "" ends) a boxed section of the panel.
+func (ss *splitScreen) setGutter(p *panel, gutter string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	p.gutter = gutter
+}
+
 // write appends text to a panel region. Thread-safe.
 func (ss *splitScreen) write(p *panel, text string) {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
+	text, p.partial = splitUTF8(p.partial + text)
+	if renderOpts.compact {
+		text = p.squeeze.squeeze(text)
+	}
+	if p.gutter != "" {
+		text = p.indent(text)
+	}
 	var out strings.Builder
 	ss.writeInto(p, text, &out)
 	fmt.Fprintf(&out, "\033[%d;1H", ss.statusR)
@@ -223,37 +519,799 @@ func (ss *splitScreen) write(p *panel, text string) {
 func (ss *splitScreen) setStatus(text string) {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
-	fmt.Printf("\033[%d;1H\033[2K%s", ss.statusR, text)
+	var out strings.Builder
+	fmt.Fprintf(&out, "\033[%d;1H\033[2K%s", ss.statusR, text)
+	ss.drawTokens(&out)
+	fmt.Print(out.String())
+}
+
+// resetPanel blanks a panel and forgets its content, token count and the
+// layout state a run leaves behind (an open box's gutter, --compact's blank
+// lines), for a fresh run in the same place.
+func (ss *splitScreen) resetPanel(p *panel) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	p.cr, p.cc = 0, 0
+	p.lines, p.clipped = nil, nil
+	p.curLine.Reset()
+	p.buf.Reset()
+	p.partial = ""
+	p.squeeze, p.gutter = blankSqueezer{}, ""
+	p.tokens, p.base, p.exact, p.alive = 0, 0, false, false
+	var out strings.Builder
+	blank := strings.Repeat(" ", p.w)
+	for r := 0; r < p.h; r++ {
+		fmt.Fprintf(&out, "\033[%d;%dH%s", p.r0+r, p.c0, blank)
+	}
+	fmt.Fprintf(&out, "\033[%d;1H", ss.statusR)
+	fmt.Print(out.String())
+}
+
+// setTitle renames a panel and redraws its title.
+func (ss *splitScreen) setTitle(p *panel, title string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var out strings.Builder
+	// Blank the old title first in case the new one is shorter.
+	fmt.Fprintf(&out, "\033[%d;%dH%s", p.r0-1, p.c0+1, strings.Repeat("─", stringWidth(p.shownTitle())+2))
+	p.title = title
+	drawTitle(p, &out)
+	fmt.Fprintf(&out, "\033[%d;1H", ss.statusR)
+	fmt.Print(out.String())
+}
+
+// beginOutput starts counting a new request's tokens on top of the panel's
+// earlier ones (the meta-prompt panel makes two requests).
+func (ss *splitScreen) beginOutput(p *panel) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	p.base, p.exact, p.alive = p.tokens, false, false
+}
+
+// ping records a heartbeat on p's stream. Until its first tokens arrive the
+// status row shows "alive" (or "жив") for p, so a slow first token doesn't
+// look like a dead connection.
+func (ss *splitScreen) ping(p *panel) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if p.alive || p.exact || p.tokens > p.base {
+		return
+	}
+	p.alive = true
+	var out strings.Builder
+	ss.drawTokens(&out)
+	fmt.Print(out.String())
+}
+
+// setOutput updates a panel's live output-token count for the current
+// request. Once an exact count arrives, later estimates are ignored.
+func (ss *splitScreen) setOutput(p *panel, n int, exact bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if p.exact && !exact {
+		return
+	}
+	p.tokens, p.exact = p.base+n, exact
+	p.alive = p.alive && p.tokens == p.base
+	var out strings.Builder
+	ss.drawTokens(&out)
+	fmt.Print(out.String())
+}
+
+// drawTokens right-aligns each panel's output-token count, in the panel's
+// color, on the status row while streams are running; "~" marks estimates.
+// Caller holds mu.
+func (ss *splitScreen) drawTokens(out *strings.Builder) {
+	if ss.doneCount >= len(ss.panels) {
+		return
+	}
+	var parts []string
+	width := len("  tok ") + 3*(len(ss.panels)-1) // separators are " · "
+	for _, p := range ss.panels {
+		n := strconv.Itoa(p.tokens)
+		if !p.exact {
+			n = "~" + n
+		}
+		if p.alive {
+			n = ss.text("жив", "alive")
+		}
+		width += stringWidth(n)
+		parts = append(parts, p.color+n+"\033[0m")
+	}
+	fmt.Fprintf(out, "\033[%d;%dH  tok %s\033[%d;1H", ss.statusR, ss.termW-width+1, strings.Join(parts, " · "), ss.statusR)
 }
 
 func (ss *splitScreen) markDone() {
 	ss.mu.Lock()
 	ss.doneCount++
 	n := ss.doneCount
-	total := ss.panelCount
+	total := len(ss.panels)
 	ss.mu.Unlock()
 	if n < total {
-		ss.setStatus(fmt.Sprintf("Streaming... (%d/%d готово) — Ctrl+C чтобы отменить", n, total))
+		ss.setStatus(fmt.Sprintf(ss.text(
+			"Streaming... (%d/%d готово) — Ctrl+C отменить всё, 1-%d — одну панель",
+			"Streaming... (%d/%d done) — Ctrl+C cancels all, 1-%d one panel"), n, total, total))
+	} else {
+		alert(ss.bell, "Comparison finished")
+	}
+}
+
+// streamPanels runs jobs[i] for panel i concurrently, each under its own
+// context derived from ctx, and returns when all are done. While they run,
+// pressing a panel's digit cancels just that panel.
+func (ss *splitScreen) streamPanels(ctx context.Context, jobs []func(ctx context.Context)) {
+	ss.jobs = jobs
+	ss.runPanels(ctx, ss.panels)
+}
+
+// errStopped marks a panel that --fail-fast cut short, so it is retried
+// along with the panel that failed.
+var errStopped = errors.New("stopped by --fail-fast")
+
+// runPanels runs the jobs of the given panels; see streamPanels.
+func (ss *splitScreen) runPanels(ctx context.Context, panels []*panel) {
+	ctx, stopAll := context.WithCancel(ctx)
+	defer stopAll()
+	var wg sync.WaitGroup
+	for _, p := range panels {
+		job := ss.jobs[slices.Index(ss.panels, p)]
+		pctx, cancel := context.WithCancel(ctx)
+		p.cancel = cancel
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+			defer ss.markDone() // however the job ends, so the count reaches the total
+			job(pctx)
+			switch {
+			case p.err != nil && ss.failFast && ss.stopOthers(p):
+				stopAll()
+			case pctx.Err() != nil && ctx.Err() == nil:
+				ss.write(p, ss.text("\n[отменено]", "\n[cancelled]"))
+			case pctx.Err() != nil && ss.failedPanel() != nil:
+				p.err = errStopped
+				ss.write(p, ss.text("\n[остановлено: ошибка в другой панели]", "\n[stopped: another panel failed]"))
+			}
+			ss.markOutcome(p, pctx.Err() != nil)
+			ss.judge(p)
+		}()
 	}
+	stop := ss.watchKeys()
+	wg.Wait()
+	stop()
 }
 
-// viewPanel shows a panel's full content in full-screen with markdown rendering.
-func (ss *splitScreen) viewPanel(idx int) {
+// Title markers for panels that did not finish normally. Titles hold them
+// plain, so widths and plainTitle work; styledMark colors them for display.
+const (
+	markFailed    = " ⚠"
+	markCancelled = " ⊘"
+)
+
+// styledMark is an outcome marker in its theme color.
+func styledMark(mark string) string {
+	style := activeTheme.muted
+	if mark == markFailed {
+		style = activeTheme.failed
+	}
+	if style == "" {
+		return mark
+	}
+	return style + mark + "\033[0m"
+}
+
+// markOutcome flags a finished panel's title when its run failed or was
+// cancelled, so the outcome shows without reading the panel. A panel that
+// --fail-fast cut short counts as cancelled, leaving the one that failed
+// the only panel marked failed.
+func (ss *splitScreen) markOutcome(p *panel, cancelled bool) {
+	p.stopped = cancelled && (p.err == nil || p.err == errStopped)
+	switch {
+	case p.stopped:
+		ss.setTitle(p, p.title+markCancelled)
+	case p.err != nil:
+		ss.setTitle(p, p.title+markFailed)
+	}
+}
+
+// plainTitle strips the outcome and --expected markers from a title.
+func plainTitle(title string) string {
+	for {
+		t := title
+		for _, mark := range []string{markFailed, markCancelled, " ✓", " ✗"} {
+			t = strings.TrimSuffix(t, mark)
+		}
+		if t == title {
+			return t
+		}
+		title = t
+	}
+}
+
+// outcomes summarizes failed and cancelled panels for the final status line.
+func (ss *splitScreen) outcomes() string {
+	var failed, cancelled []string
+	for i, p := range ss.panels {
+		switch {
+		case p.stopped: // including panels --fail-fast stopped
+			cancelled = append(cancelled, strconv.Itoa(i+1))
+		case p.err != nil:
+			failed = append(failed, strconv.Itoa(i+1))
+		}
+	}
+	var s string
+	if len(failed) > 0 {
+		s += fmt.Sprintf(ss.text("Ошибка%s: %s. ", "Failed%s: %s. "), styledMark(markFailed), strings.Join(failed, ", "))
+	}
+	if len(cancelled) > 0 && len(cancelled) < len(ss.panels) { // else the status says it
+		s += fmt.Sprintf(ss.text("Отменено%s: %s. ", "Cancelled%s: %s. "), styledMark(markCancelled), strings.Join(cancelled, ", "))
+	}
+	return s
+}
+
+// failedPanels returns the panels whose last run failed.
+func (ss *splitScreen) failedPanels() []*panel {
+	var failed []*panel
+	for _, p := range ss.panels {
+		if p.err != nil {
+			failed = append(failed, p)
+		}
+	}
+	return failed
+}
+
+// failure is the error of a comparison in which every panel failed, for the
+// exit code; nil if any panel got through.
+func (ss *splitScreen) failure() error {
+	failed := ss.failedPanels()
+	if len(failed) < len(ss.panels) {
+		return nil
+	}
+	p := failed[0]
+	if first := ss.failedPanel(); first != nil {
+		p = first // the others only report being stopped by it
+	}
+	return fmt.Errorf("every panel failed: %w", p.err)
+}
+
+// retryFailed streams the failed panels again, in place, with the same jobs
+// and question. It reports false when there was nothing to retry.
+func (ss *splitScreen) retryFailed() bool {
+	failed := ss.failedPanels()
+	if len(failed) == 0 || ss.jobs == nil {
+		return false
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	ss.mu.Lock()
+	ss.doneCount = len(ss.panels) - len(failed)
+	ss.failed = nil
+	ss.mu.Unlock()
+	for _, p := range failed {
+		p.err, p.reply, p.correct = nil, "", false
+		ss.resetPanel(p)
+		ss.setTitle(p, plainTitle(p.title))
+	}
+	fmt.Print("\033[?25l")
+	ss.setStatus(fmt.Sprintf(ss.text(
+		"Повтор %d панелей с ошибкой... Ctrl+C — отменить",
+		"Retrying %d failed panel(s)... Ctrl+C cancels"), len(failed)))
+	ss.runPanels(ctx, failed)
+	return true
+}
+
+// stopOthers records p as the panel that stops the rest under --fail-fast.
+// Only the first failure counts; it reports whether p was it.
+func (ss *splitScreen) stopOthers(p *panel) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.failed != nil {
+		return false
+	}
+	ss.failed = p
+	return true
+}
+
+func (ss *splitScreen) failedPanel() *panel {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.failed
+}
+
+// failNote names the panel whose failure stopped the comparison, for the
+// status line; it is empty unless --fail-fast kicked in.
+func (ss *splitScreen) failNote() string {
+	p := ss.failedPanel()
+	if p == nil {
+		return ""
+	}
+	return ss.text(
+		fmt.Sprintf("Остановлено (--fail-fast): «%s» — %s. ", p.title, truncate(redact(p.err.Error()), 60)),
+		fmt.Sprintf("Stopped (--fail-fast): %s — %s. ", p.title, truncate(redact(p.err.Error()), 60)))
+}
+
+// watchKeys reads keys while panels stream; a panel's digit cancels that
+// panel. Ctrl+C still raises SIGINT. The returned func stops the watcher
+// and restores the terminal before anything else reads stdin.
+func (ss *splitScreen) watchKeys() (stop func()) {
+	return watchStdin(func(b byte) {
+		if i := int(b) - '1'; i >= 0 && i < len(ss.panels) {
+			ss.panels[i].cancel()
+		}
+	})
+}
+
+// viewPanel shows a panel's full content in full-screen with markdown
+// rendering. On a terminal that is a pager (see pagePanel); otherwise the
+// text is printed once and Enter returns, "n" toggling line numbers.
+func (ss *splitScreen) viewPanel(idx int, in *bufio.Reader) {
 	p := ss.panels[idx]
+	if isTerminal(os.Stdin) && isTerminal(os.Stdout) && ss.page(p.color+" "+p.title+" \033[0m", func() string {
+		var refs linkRefs
+		text := renderMarkdown(p.buf.String(), &refs)
+		if notes := refs.notes(); notes != "" {
+			text += "\n\n" + notes
+		}
+		return text
+	}) {
+		return
+	}
+	for {
+		ss.showPanel(p)
+		if line, err := readLine(in); err != nil || strings.TrimSpace(line) != "n" {
+			return
+		}
+		ss.lineNums = !ss.lineNums
+	}
+}
+
+func (ss *splitScreen) showPanel(p *panel) {
 	w := ss.termW
 
 	fmt.Print("\033[2J\033[H")
 	fmt.Printf("%s %s \033[0m\n", p.color, p.title)
 	fmt.Println(strings.Repeat("─", w))
 	fmt.Println()
-	fmt.Print(renderMarkdown(p.buf.String()))
-	fmt.Printf("\n\n%s\n\033[2mНажми Enter чтобы вернуться к результатам.\033[0m", strings.Repeat("─", w))
+	var refs linkRefs
+	text := renderMarkdown(p.buf.String(), &refs)
+	if ss.lineNums {
+		text = numberLines(text)
+	}
+	fmt.Print(text)
+	if notes := refs.notes(); notes != "" {
+		fmt.Print("\n\n" + notes)
+	}
+	fmt.Printf("\n\n%s\n\033[2mEnter — вернуться к результатам, n + Enter — номера строк.\033[0m", strings.Repeat("─", w))
+}
+
+// numberLines prefixes each display line with a dim, right-aligned number.
+// The gutter only resets intensity, so colors spanning lines carry through.
+func numberLines(text string) string {
+	lines := strings.Split(text, "\n")
+	width := len(strconv.Itoa(len(lines)))
+	var b strings.Builder
+	for i, line := range lines {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		fmt.Fprintf(&b, "\033[2m%*d │\033[22m %s", width, i+1, line)
+	}
+	return b.String()
+}
+
+// viewQuestion shows the whole question, which the header may cut short.
+func (ss *splitScreen) viewQuestion(in *bufio.Reader) {
+	header := "\033[1m " + strings.TrimSuffix(ss.label(), ": ") + " \033[0m"
+	if isTerminal(os.Stdin) && isTerminal(os.Stdout) && ss.page(header, func() string { return ss.question }) {
+		return
+	}
+	fmt.Print("\033[2J\033[H")
+	fmt.Printf("%s\n%s\n\n%s\n\n", header, strings.Repeat("─", ss.termW), ss.question)
+	fmt.Printf("%s\n\033[2mНажми Enter чтобы вернуться к результатам.\033[0m", strings.Repeat("─", ss.termW))
+	readLine(in)
+}
+
+// navigate runs the post-stream loop: a digit opens that panel full-screen,
+// q shows the whole question, r re-runs the failed panels, Enter leaves.
+// The status line comes from status, asked again after each retry. It
+// reports false when stdin hit EOF instead (the cursor is visible again
+// either way), so callers can skip any further prompts.
+func (ss *splitScreen) navigate(in *bufio.Reader, status func() string) bool {
+	msg := ""
+	refresh := func() {
+		msg = status()
+		if n := len(ss.failedPanels()); n > 0 && ss.jobs != nil {
+			msg += fmt.Sprintf(ss.text(" r — повторить панели с ошибкой (%d).", " r re-runs the %d failed panel(s)."), n)
+		}
+	}
+	refresh()
+	for {
+		ss.setStatus(msg)
+		fmt.Print("\033[?25h")
+		line, err := readLine(in)
+		if err != nil {
+			return false
+		}
+		input := strings.TrimSpace(line)
+
+		if input == "" {
+			return true
+		}
+		switch n := int(input[0] - '1'); {
+		case input == "q":
+			ss.viewQuestion(in)
+		case len(input) == 1 && n >= 0 && n < len(ss.panels):
+			ss.viewPanel(n, in)
+		case input == "r" && ss.retryFailed():
+			refresh()
+		default:
+			continue
+		}
+		ss.redraw()
+		fmt.Print("\033[?25l")
+	}
+}
+
+// page is a less-style pager over the text from render, shown under header:
+// j/k or arrows scroll, space/b page, g/G jump to the ends, / searches as
+// you type, n/N move between matches (n toggles line numbers when nothing
+// is searched), Esc clears the search, and q or Enter returns. It reports
+// false if the terminal can't be switched to raw mode.
+func (ss *splitScreen) page(header string, render func() string) bool {
+	restore, err := sttyMode("raw", "-echo")
+	if err != nil {
+		return false
+	}
+	defer restore()
+	in := stdin
+
+	w := ss.termW
+	_, h := termSize()
+	body := h - 3 // title, rule and status rows
+
+	var lines, carry []string
+	build := func() {
+		text := render()
+		if ss.lineNums {
+			text = numberLines(text)
+		}
+		lines = wrapANSI(strings.Split(text, "\n"), w)
+		carry = carrySGR(lines)
+	}
+	build()
+
+	top := 0
+	maxTop := func() int { return max(len(lines)-body, 0) }
+	var query string
+	var matches []int // rows matching query
+	cur := -1         // index into matches
+	searching := false
+	find := func(from int) {
+		matches, cur = nil, -1
+		if query == "" {
+			return
+		}
+		q := strings.ToLower(query)
+		for i, l := range lines {
+			if strings.Contains(strings.ToLower(stripANSI(l)), q) {
+				matches = append(matches, i)
+				if cur < 0 && i >= from {
+					cur = len(matches) - 1
+				}
+			}
+		}
+		if cur < 0 && len(matches) > 0 {
+			cur = 0
+		}
+		if cur >= 0 {
+			top = min(matches[cur], maxTop())
+		}
+	}
+	step := func(d int) {
+		if len(matches) > 0 {
+			cur = (cur + d + len(matches)) % len(matches)
+			top = min(matches[cur], maxTop())
+		}
+	}
+
+	fmt.Print("\033[?25l")
+	for {
+		var out strings.Builder
+		fmt.Fprintf(&out, "\033[H\033[2K%s\033[2;1H%s", header, strings.Repeat("─", w))
+		for r := 0; r < body; r++ {
+			fmt.Fprintf(&out, "\033[%d;1H\033[0m\033[2K", r+3)
+			if i := top + r; i < len(lines) {
+				out.WriteString(carry[i] + highlight(lines[i], query))
+			}
+		}
+		fmt.Fprintf(&out, "\033[0m\033[%d;1H\033[2K", h)
+		switch {
+		case searching:
+			fmt.Fprintf(&out, "/%s", query)
+		case query != "" && len(matches) == 0:
+			fmt.Fprintf(&out, "\033[2m«%s» не найдено — Esc сбросить поиск\033[0m", query)
+		case query != "":
+			fmt.Fprintf(&out, "\033[2m«%s»: %d из %d — n/N следующее/предыдущее, Esc сбросить\033[0m", query, cur+1, len(matches))
+		default:
+			fmt.Fprintf(&out, "\033[2mстроки %d–%d из %d — ↑↓ пробел/b листать, / поиск, n номера строк, q назад\033[0m",
+				min(top+1, len(lines)), min(top+body, len(lines)), len(lines))
+		}
+		fmt.Print(out.String())
+
+		r, _, err := in.ReadRune()
+		if err != nil {
+			return true
+		}
+		if searching {
+			switch r {
+			case '\r', '\n':
+				searching = false
+			case 27, 3: // Esc, Ctrl+C
+				searching, query = false, ""
+				find(top)
+				readEscape(in)
+			case 127, 8:
+				if q := []rune(query); len(q) > 0 {
+					query = string(q[:len(q)-1])
+					find(top)
+				}
+			default:
+				if r >= ' ' {
+					query += string(r)
+					find(top)
+				}
+			}
+			continue
+		}
+
+		key := string(r)
+		if r == 27 {
+			key = readEscape(in)
+		}
+		switch key {
+		case "q", "\r", "\n", "\x03":
+			return true
+		case "", "\x1b": // lone Esc
+			query = ""
+			find(top)
+		case "j", "[B", "OB":
+			top = min(top+1, maxTop())
+		case "k", "[A", "OA":
+			top = max(top-1, 0)
+		case " ", "f", "[6~":
+			top = min(top+body, maxTop())
+		case "b", "[5~":
+			top = max(top-body, 0)
+		case "g", "[H", "[1~", "OH":
+			top = 0
+		case "G", "[F", "[4~", "OF":
+			top = maxTop()
+		case "/":
+			searching, query = true, ""
+			find(top)
+		case "n":
+			if query == "" {
+				ss.lineNums = !ss.lineNums
+				build()
+				top = min(top, maxTop())
+			} else {
+				step(1)
+			}
+		case "N":
+			step(-1)
+		}
+	}
+}
+
+// tabWidth is stop, or 4 when stop is below 1, as in render options that
+// did not come from --tabstop.
+func tabWidth(stop int) int {
+	if stop < 1 {
+		return 4
+	}
+	return stop
+}
+
+// expandTabs replaces each tab in s with spaces up to the next multiple of
+// stop. s starts at column col of its line; escape sequences take no columns.
+func expandTabs(s string, col, stop int) string {
+	if !strings.Contains(s, "\t") {
+		return s
+	}
+	stop = tabWidth(stop)
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		if n := ansiLen(s[i:]); n > 0 {
+			b.WriteString(s[i : i+n])
+			i += n
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+		switch r {
+		case '\t':
+			n := stop - col%stop
+			b.WriteString(strings.Repeat(" ", n))
+			col += n
+		case '\n':
+			b.WriteRune(r)
+			col = 0
+		default:
+			b.WriteRune(r)
+			col += runeWidth(r)
+		}
+	}
+	return b.String()
+}
+
+// escapeControls makes control characters in model output harmless before
+// they reach a panel: C0 controls (ESC above all, so a raw "\033[31m" can't
+// move the cursor) become their visible Control Pictures (␛), DEL and C1
+// controls become U+FFFD. Newlines and tabs pass through.
+func escapeControls(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t' || r == '\r':
+			return r
+		case r < 0x20:
+			return 0x2400 + r
+		case r == 0x7f || r >= 0x80 && r <= 0x9f:
+			return utf8.RuneError
+		}
+		return r
+	}, s)
+}
+
+// runeWidth is the number of terminal cells r takes: 2 for East Asian wide
+// and fullwidth characters and emoji, 0 for combining marks and zero-width
+// joiners, 1 otherwise.
+func runeWidth(r rune) int {
+	switch {
+	case r == 0x200d || unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case r >= 0x1100 && r <= 0x115f, // Hangul Jamo
+		r >= 0x2e80 && r <= 0x303e, // CJK radicals, punctuation
+		r >= 0x3041 && r <= 0x33ff, // kana, CJK compatibility
+		r >= 0x3400 && r <= 0x4dbf, // CJK extension A
+		r >= 0x4e00 && r <= 0x9fff, // CJK unified ideographs
+		r >= 0xa000 && r <= 0xa4cf, // Yi
+		r >= 0xac00 && r <= 0xd7a3, // Hangul syllables
+		r >= 0xf900 && r <= 0xfaff, // CJK compatibility ideographs
+		r >= 0xfe30 && r <= 0xfe4f, // CJK compatibility forms
+		r >= 0xff00 && r <= 0xff60, // fullwidth forms
+		r >= 0xffe0 && r <= 0xffe6,
+		r >= 0x1f300 && r <= 0x1f64f, // emoji: symbols, pictographs, emoticons
+		r >= 0x1f680 && r <= 0x1f6ff, // transport and map symbols
+		r >= 0x1f900 && r <= 0x1f9ff, // supplemental symbols and pictographs
+		r >= 0x20000 && r <= 0x3fffd: // CJK extensions B and later
+		return 2
+	}
+	return 1
+}
+
+// stringWidth is the number of terminal cells s takes.
+func stringWidth(s string) int {
+	n := 0
+	for _, r := range s {
+		n += runeWidth(r)
+	}
+	return n
+}
+
+// ansiLen returns the length of the escape sequence at the start of s, or 0.
+func ansiLen(s string) int {
+	if len(s) < 2 || s[0] != 0x1b || s[1] != '[' {
+		return 0
+	}
+	for i := 2; i < len(s); i++ {
+		if s[i] >= 0x40 && s[i] <= 0x7e {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func stripANSI(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		if n := ansiLen(s[i:]); n > 0 {
+			i += n
+			continue
+		}
+		b.WriteByte(s[i])
+		i++
+	}
+	return b.String()
+}
+
+// wrapANSI splits lines wider than w cells, leaving escape sequences intact.
+func wrapANSI(lines []string, w int) []string {
+	var rows []string
+	for _, line := range lines {
+		start, col := 0, 0
+		for i := 0; i < len(line); {
+			if n := ansiLen(line[i:]); n > 0 {
+				i += n
+				continue
+			}
+			r, size := utf8.DecodeRuneInString(line[i:])
+			rw := runeWidth(r)
+			if col+rw > w && col > 0 {
+				rows = append(rows, line[start:i])
+				start, col = i, 0
+			}
+			i += size
+			col += rw
+		}
+		rows = append(rows, line[start:])
+	}
+	return rows
+}
+
+// carrySGR returns, for every row, the SGR sequences still in effect from
+// the rows above it, so a row can be drawn on its own with the right style.
+func carrySGR(rows []string) []string {
+	carry := make([]string, len(rows))
+	active := ""
+	for i, row := range rows {
+		carry[i] = active
+		for j := 0; j < len(row); j++ {
+			if n := ansiLen(row[j:]); n > 0 {
+				if seq := row[j : j+n]; seq[n-1] == 'm' {
+					if seq == "\033[0m" || seq == "\033[m" {
+						active = ""
+					} else {
+						active += seq
+					}
+				}
+				j += n - 1
+			}
+		}
+	}
+	return carry
+}
+
+// highlight shows case-insensitive matches of query in reverse video.
+func highlight(line, query string) string {
+	if query == "" {
+		return line
+	}
+	q := []rune(strings.ToLower(query))
+	var plain []rune
+	var offs []int // byte offset in line of each plain rune
+	for i := 0; i < len(line); {
+		if n := ansiLen(line[i:]); n > 0 {
+			i += n
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(line[i:])
+		plain = append(plain, unicode.ToLower(r))
+		offs = append(offs, i)
+		i += size
+	}
+	offs = append(offs, len(line))
+
+	var b strings.Builder
+	last := 0
+	for i := 0; i+len(q) <= len(plain); {
+		if !slices.Equal(plain[i:i+len(q)], q) {
+			i++
+			continue
+		}
+		from, to := offs[i], offs[i+len(q)]
+		b.WriteString(line[last:from] + "\033[7m" + line[from:to] + "\033[27m")
+		last = to
+		i += len(q)
+	}
+	b.WriteString(line[last:])
+	return b.String()
 }
 
 // redraw repaints the split screen and replays all panel content.
 func (ss *splitScreen) redraw() {
 	fmt.Print("\033[2J\033[H\033[?25l")
-	ss.drawBorders()
+	ss.drawFrame()
 
 	ss.drawQuestion()
 	fmt.Printf("\033[%d;1H%s", ss.sepR, strings.Repeat("─", ss.termW))
@@ -261,7 +1319,7 @@ func (ss *splitScreen) redraw() {
 	for _, p := range ss.panels {
 		content := p.buf.String()
 		p.cr, p.cc = 0, 0
-		p.lines = nil
+		p.lines, p.clipped = nil, nil
 		p.curLine.Reset()
 		p.buf.Reset()
 		var out strings.Builder
@@ -277,82 +1335,113 @@ func (ss *splitScreen) cleanup() {
 
 // ─── API streaming to panels ──────────────────────────────────────────────────
 
+// noteErr keeps err as the panel's failure, unless the panel already has one
+// or err only reflects a cancellation.
+func (p *panel) noteErr(ctx context.Context, err error) {
+	if err != nil && ctx.Err() == nil && p.err == nil {
+		p.err = err
+	}
+}
+
+// streamToPanel streams a Messages request into p and returns the reply.
 func streamToPanel(ctx context.Context, apiKey string, cfg config, msgs []message, ss *splitScreen, p *panel) (string, error) {
+	reply, err := sendToPanel(ctx, apiKey, cfg, msgs, ss, p)
+	p.noteErr(ctx, err)
+	return reply, err
+}
+
+func sendToPanel(ctx context.Context, apiKey string, cfg config, msgs []message, ss *splitScreen, p *panel) (string, error) {
+	cfg = p.config.apply(cfg)
+	p.reply = ""
 	body, _ := json.Marshal(buildRequest(cfg, msgs))
 
 	if cfg.verbose {
-		ss.write(p, formatCurl(apiKey, body)+"\n")
+		ss.write(p, redact(formatCurl(apiKey, cfg, body))+"\n")
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.anthropic.com/v1/messages", bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", anthropicMessagesURL(cfg), bytes.NewReader(body))
 	if err != nil {
-		ss.write(p, "Error: "+err.Error())
+		ss.write(p, "Error: "+redact(err.Error()))
 		return "", err
 	}
-	req.Header.Set("x-api-key", apiKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
-	req.Header.Set("content-type", "application/json")
+	setAnthropicHeaders(req, apiKey, cfg)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := cfg.httpClient().Do(req)
 	if err != nil {
 		if ctx.Err() == nil {
-			ss.write(p, "Error: "+err.Error())
+			ss.write(p, "Error: "+redact(err.Error()))
 		}
 		return "", err
 	}
 	defer resp.Body.Close()
+	if err := decodeBody(resp); err != nil {
+		ss.write(p, "Error: "+err.Error())
+		return "", err
+	}
 
 	if resp.StatusCode != 200 {
 		b, _ := io.ReadAll(resp.Body)
-		ss.write(p, fmt.Sprintf("API error (%d)", resp.StatusCode))
-		return "", fmt.Errorf("API error %d: %s", resp.StatusCode, b)
+		e := &apiError{resp.StatusCode, string(b), "ANTHROPIC_API_KEY"}
+		ss.write(p, redact(e.Error()))
+		return "", e
 	}
 
-	return readStreamToPanel(ctx, resp.Body, ss, p)
+	reply, u, err := readStreamToPanel(ctx, resp.Body, cfg, ss, p)
+	cfg.ledger.add(cfg.model, u)
+	return reply, err
 }
 
-func readStreamToPanel(ctx context.Context, r io.Reader, ss *splitScreen, p *panel) (string, error) {
+func readStreamToPanel(ctx context.Context, r io.Reader, cfg config, ss *splitScreen, p *panel) (string, usage, error) {
 	var full strings.Builder
-	scanner := bufio.NewScanner(r)
-
-	for scanner.Scan() {
-		if ctx.Err() != nil {
-			break
-		}
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "[DONE]" {
-			break
-		}
-
-		var event struct {
-			Type  string `json:"type"`
-			Delta struct {
-				Type string `json:"type"`
-				Text string `json:"text"`
-			} `json:"delta"`
-		}
-		if err := json.Unmarshal([]byte(data), &event); err != nil {
-			continue
-		}
-		if event.Type == "content_block_delta" && event.Delta.Type == "text_delta" {
-			ss.write(p, event.Delta.Text)
-			full.WriteString(event.Delta.Text)
-		}
+	var last usage
+	chars := 0
+
+	ss.beginOutput(p)
+	err := parseAnthropicStream(r,
+		func(text string) {
+			if ctx.Err() != nil {
+				return
+			}
+			ss.write(p, text)
+			full.WriteString(text)
+			chars += utf8.RuneCountInString(text)
+			ss.setOutput(p, chars/4, false)
+		},
+		func(u usage) {
+			last = u
+			if u.stopReason != "" {
+				ss.setOutput(p, u.outputTokens, true)
+			}
+		},
+		func(err error) { ss.write(p, "\n"+redact(err.Error())) },
+		func() { ss.ping(p) })
+	if note := droppedNote(cfg, last.dropped); note != "" {
+		ss.write(p, "\n"+note)
+	}
+	if ctx.Err() != nil {
+		err = nil // cancelled, not a read error
 	}
 
-	return full.String(), scanner.Err()
+	p.reply = full.String()
+	return p.reply, last, err
 }
 
 // ─── Comparison orchestrator ──────────────────────────────────────────────────
 
-func runComparison(apiKey string, cfg config, question string, scanner *bufio.Scanner) {
+// runComparison shows the prompt techniques side by side. It returns an error
+// only when every panel failed.
+func runComparison(apiKey string, cfg config, question string, in *bufio.Reader) error {
 	ss := newSplitScreen(question)
+	ss.bell = cfg.bell
+	ss.failFast = cfg.failFast
+	ss.expect, _ = parseExpected(cfg.expected) // validated in parseArgs
 	defer ss.cleanup()
 
+	pcs, _ := techniqueConfigs(cfg) // validated in parseArgs
+	for i, pc := range pcs {
+		ss.panels[i].config = pc
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	sigCh := make(chan os.Signal, 1)
@@ -367,199 +1456,232 @@ func runComparison(apiKey string, cfg config, question string, scanner *bufio.Sc
 		signal.Stop(sigCh)
 	}()
 
-	var wg sync.WaitGroup
-	wg.Add(4)
-
-	// 1. Direct — без дополнительных инструкций
-	go func() {
-		defer wg.Done()
-		p := ss.panels[0]
-		ss.write(p, "[Промпт]\n"+question+"\n\n")
-		streamToPanel(ctx, apiKey, cfg,
-			[]message{{Role: "user", Content: question}},
-			ss, p)
-		ss.markDone()
-	}()
-
-	// 2. Step-by-step — пошаговое решение
-	go func() {
-		defer wg.Done()
-		p := ss.panels[1]
-		prompt2 := "Реши задачу пошагово:\n\n" + question
-		ss.write(p, "[Промпт]\n"+prompt2+"\n\n")
-		streamToPanel(ctx, apiKey, cfg,
-			[]message{{Role: "user", Content: prompt2}},
-			ss, p)
-		ss.markDone()
-	}()
-
-	// 3. Meta-prompting — два последовательных запроса
-	go func() {
-		defer wg.Done()
-		p := ss.panels[2]
-		metaPrompt := "Напиши оптимальный промпт для точного решения этой задачи. Верни только промпт, без пояснений:\n\n" + question
-		ss.write(p, "[Промпт]\n"+metaPrompt+"\n\n[Шаг 1] Составляю оптимальный промпт...\n\n")
-		generated, err := streamToPanel(ctx, apiKey, cfg,
-			[]message{{Role: "user", Content: metaPrompt}},
-			ss, p)
-		if err == nil && generated != "" && ctx.Err() == nil {
-			ss.write(p, "\n\n[Шаг 2] Использую сгенерированный промпт...\n\n")
+	ss.streamPanels(ctx, []func(context.Context){
+		// 1. Direct — без дополнительных инструкций
+		func(ctx context.Context) {
+			p := ss.panels[0]
+			ss.write(p, "[Промпт]\n"+question+"\n\n")
 			streamToPanel(ctx, apiKey, cfg,
-				[]message{{Role: "user", Content: generated}},
+				[]message{{Role: "user", Content: question}},
 				ss, p)
-		}
-		ss.markDone()
-	}()
+		},
 
-	// 4. Expert panel — группа экспертов
-	go func() {
-		defer wg.Done()
-		p := ss.panels[3]
-		expertPrompt := "Ты — группа из трёх экспертов, которые вместе решают задачу:\n" +
-			"- Аналитик: опирается на теорию вероятностей и формальные рассуждения\n" +
-			"- Математик: выполняет точные вычисления\n" +
-			"- Критик: проверяет допущения и верифицирует ответ\n\n" +
-			"Каждый эксперт кратко высказывает свою точку зрения, затем группа приходит к единому ответу.\n\n" +
-			"Задача: " + question
-		ss.write(p, "[Промпт]\n"+expertPrompt+"\n\n")
-		streamToPanel(ctx, apiKey, cfg,
-			[]message{{Role: "user", Content: expertPrompt}},
-			ss, p)
-		ss.markDone()
-	}()
+		// 2. Step-by-step — пошаговое решение
+		func(ctx context.Context) {
+			p := ss.panels[1]
+			prompt2 := "Реши задачу пошагово:\n\n" + question
+			ss.write(p, "[Промпт]\n"+prompt2+"\n\n")
+			streamToPanel(ctx, apiKey, cfg,
+				[]message{{Role: "user", Content: prompt2}},
+				ss, p)
+		},
+
+		// 3. Meta-prompting — два последовательных запроса
+		func(ctx context.Context) {
+			p := ss.panels[2]
+			metaPrompt := "Напиши оптимальный промпт для точного решения этой задачи. Верни только промпт, без пояснений:\n\n" + question
+			ss.write(p, "[Промпт]\n"+metaPrompt+"\n\n[Шаг 1] Составляю оптимальный промпт...\n\n┌─ Сгенерированный промпт\n")
+			// The generated prompt is boxed so it doesn't run into the answer.
+			ss.setGutter(p, "│ ")
+			generated, err := streamToPanel(ctx, apiKey, cfg,
+				[]message{{Role: "user", Content: metaPrompt}},
+				ss, p)
+			ss.setGutter(p, "")
+			if !strings.HasSuffix(generated, "\n") {
+				ss.write(p, "\n")
+			}
+			ss.write(p, "└─\n\n")
+			switch {
+			case err != nil || ctx.Err() != nil:
+				// The error (or cancellation) is already in the panel.
+			case strings.TrimSpace(generated) == "":
+				ss.write(p, "[Шаг 2 пропущен] Модель вернула пустой промпт.")
+			case looksLikeRefusal(generated):
+				ss.write(p, "[Шаг 2 пропущен] Вместо промпта модель ответила отказом.")
+			default:
+				ss.write(p, "[Шаг 2] Ответ по сгенерированному промпту:\n\n")
+				streamToPanel(ctx, apiKey, cfg,
+					[]message{{Role: "user", Content: generated}},
+					ss, p)
+			}
+		},
+
+		// 4. Expert panel — группа экспертов
+		func(ctx context.Context) {
+			p := ss.panels[3]
+			expertPrompt := "Ты — группа из трёх экспертов, которые вместе решают задачу:\n" +
+				"- Аналитик: опирается на теорию вероятностей и формальные рассуждения\n" +
+				"- Математик: выполняет точные вычисления\n" +
+				"- Критик: проверяет допущения и верифицирует ответ\n\n" +
+				"Каждый эксперт кратко высказывает свою точку зрения, затем группа приходит к единому ответу.\n\n" +
+				"Задача: " + question
+			ss.write(p, "[Промпт]\n"+expertPrompt+"\n\n")
+			streamToPanel(ctx, apiKey, cfg,
+				[]message{{Role: "user", Content: expertPrompt}},
+				ss, p)
+		},
+
+		// 5. Self-consistency — несколько ответов при temperature 1.0, затем выбор самого согласованного
+		func(ctx context.Context) {
+			p := ss.panels[4]
+			hot := cfg
+			hot.temperature = 1.0
+			ss.write(p, fmt.Sprintf("[Промпт]\n%s\n\n[Шаг 1] Ответов при temperature 1.0: %d\n", question, cfg.samples))
+			var samples []string
+			for i := range cfg.samples {
+				if ctx.Err() != nil {
+					return
+				}
+				ss.write(p, fmt.Sprintf("\n┌─ Ответ %d/%d\n", i+1, cfg.samples))
+				ss.setGutter(p, "│ ")
+				sample, err := streamToPanel(ctx, apiKey, hot,
+					[]message{{Role: "user", Content: question}},
+					ss, p)
+				ss.setGutter(p, "")
+				if !strings.HasSuffix(sample, "\n") {
+					ss.write(p, "\n")
+				}
+				ss.write(p, "└─\n")
+				if err == nil && strings.TrimSpace(sample) != "" {
+					samples = append(samples, sample)
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if len(samples) < 2 {
+				ss.write(p, "\n[Шаг 2 пропущен] Для сравнения нужно хотя бы два ответа.")
+				return
+			}
 
-	wg.Wait()
+			var vote strings.Builder
+			fmt.Fprintf(&vote, "Вот несколько независимых ответов на одну задачу.\n\nЗадача: %s\n\n", question)
+			for i, s := range samples {
+				fmt.Fprintf(&vote, "Ответ %d:\n%s\n\n", i+1, s)
+			}
+			vote.WriteString("Определи итоговый ответ, с которым согласно большинство ответов. Назови его и кратко объясни выбор.")
+			ss.write(p, "\n[Шаг 2] Самый согласованный ответ:\n\n")
+			streamToPanel(ctx, apiKey, cfg,
+				[]message{{Role: "user", Content: vote.String()}},
+				ss, p)
+		},
+	})
 
 	wasCancelled := ctx.Err() != nil
 	cancel()
 
-	// Navigation loop: 1–4 = full-screen view, Enter = exit
-	for {
-		msg := "Готово! Введи 1-4 для просмотра панели, Enter для выхода в чат."
-		if wasCancelled {
-			msg = "Отменено. Введи 1-4 для просмотра панели, Enter для выхода в чат."
-		}
-		ss.setStatus(msg)
-		fmt.Print("\033[?25h")
-		scanner.Scan()
-		input := strings.TrimSpace(scanner.Text())
-
-		if input == "" {
-			break
-		}
-		if len(input) == 1 && input[0] >= '1' && input[0] <= '4' {
-			ss.viewPanel(int(input[0] - '1'))
-			scanner.Scan() // wait for Enter
-			ss.redraw()
-			fmt.Print("\033[?25l")
-		}
+	msg := "Готово! Введи 1-5 для просмотра панели, q — вопрос целиком, Enter — выход в чат."
+	if wasCancelled {
+		msg = "Отменено. Введи 1-5 для просмотра панели, q — вопрос целиком, Enter — выход в чат."
 	}
+	ss.navigate(in, func() string {
+		return ss.failNote() + ss.outcomes() + ss.tally() + ss.save(cfg.saveCmp, "compare", nil) + msg
+	})
 
 	fmt.Print("\033[?25h")
 	_, h := termSize()
 	fmt.Printf("\033[%d;1H\n", h)
+	return ss.failure()
 }
 
-// ─── Temperature comparison ──────────────────────────────────────────────────
-
-func newTempScreen(question string) *splitScreen {
-	w, h := termSize()
-	third := w / 3
-
-	// Layout: 3 columns, single row of panels
-	//   row 1            top border
-	//   row 2..pH+1      panel content
-	//   row pH+2         bottom border
-	//   row pH+3         question line 1
-	//   row pH+4         question line 2
-	//   row pH+5         separator
-	//   row pH+6         status
-	// => panelH = h - 6
-	panelH := h - 6
-	if panelH < 3 {
-		panelH = 3
+// looksLikeRefusal reports whether a generated meta-prompt reads like the
+// model declining the task rather than a prompt to run.
+func looksLikeRefusal(s string) bool {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for _, prefix := range []string{
+		"i can't", "i cannot", "i can’t", "i'm sorry", "i’m sorry", "sorry", "i won't", "i am unable", "i'm unable",
+		"извините", "простите", "к сожалению", "я не могу", "не могу",
+	} {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
 	}
+	return false
+}
 
-	questR := panelH + 3
-	sepR := panelH + 5
-	statusR := panelH + 6
+// ─── Expected answers ────────────────────────────────────────────────────────
 
-	panels := [4]*panel{
-		{title: "temp=0", color: "\033[94m", r0: 2, c0: 2, w: third - 1, h: panelH},
-		{title: "temp=0.7", color: "\033[92m", r0: 2, c0: third + 2, w: third - 1, h: panelH},
-		{title: "temp=1.0", color: "\033[93m", r0: 2, c0: 2*third + 2, w: w - 2*third - 2, h: panelH},
-		{}, // unused 4th slot
-	}
+// expectation is an --expected answer: /regex/ or plain text, both matched
+// case-insensitively; plain text also ignores surrounding and repeated spaces.
+type expectation struct {
+	re   *regexp.Regexp
+	text string
+}
 
-	ss := &splitScreen{
-		panels: panels, panelCount: 3, termW: w, half: third, panelH: panelH,
-		midRow: 0, questR: questR, sepR: sepR, statusR: statusR,
-		question: question,
+func parseExpected(s string) (*expectation, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
 	}
-
-	fmt.Print("\033[2J\033[H\033[?25l")
-	ss.drawTempBorders()
-
-	ss.drawQuestion()
-	fmt.Printf("\033[%d;1H%s", sepR, strings.Repeat("─", w))
-	fmt.Printf("\033[%d;1HStreaming... (Ctrl+C — отменить)", statusR)
-
-	return ss
+	if len(s) > 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		re, err := regexp.Compile("(?i)" + s[1:len(s)-1])
+		if err != nil {
+			return nil, fmt.Errorf("--expected: %w", err)
+		}
+		return &expectation{re: re}, nil
+	}
+	return &expectation{text: normalizeAnswer(s)}, nil
 }
 
-func (ss *splitScreen) drawTempBorders() {
-	w := ss.termW
-	third := ss.half
-	panelH := ss.panelH
-
-	h1 := strings.Repeat("─", third-1)
-	h2 := strings.Repeat("─", third-1)
-	h3 := strings.Repeat("─", w-2*third-2)
+func normalizeAnswer(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
 
-	// top border
-	fmt.Printf("\033[1;1H┌%s┬%s┬%s┐", h1, h2, h3)
-	// panel rows
-	for r := 2; r <= panelH+1; r++ {
-		fmt.Printf("\033[%d;1H│\033[%d;%dH│\033[%d;%dH│\033[%d;%dH│",
-			r, r, third+1, r, 2*third+1, r, w)
+func (e *expectation) matches(reply string) bool {
+	if e.re != nil {
+		return e.re.MatchString(reply)
 	}
-	// bottom border
-	fmt.Printf("\033[%d;1H└%s┴%s┴%s┘", panelH+2, h1, h2, h3)
+	return strings.Contains(normalizeAnswer(reply), e.text)
+}
 
-	// panel titles
-	titles := [3]struct{ col int; color, name string }{
-		{3, ss.panels[0].color, ss.panels[0].title},
-		{third + 3, ss.panels[1].color, ss.panels[1].title},
-		{2*third + 3, ss.panels[2].color, ss.panels[2].title},
+// judge marks a finished panel ✓ or ✗ in its title. Cancelled and failed
+// panels count as wrong even if their partial reply would match.
+func (ss *splitScreen) judge(p *panel) {
+	if ss.expect == nil {
+		return
 	}
-	for _, t := range titles {
-		fmt.Printf("\033[1;%dH%s %s \033[0m", t.col, t.color, t.name)
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	p.correct = p.err == nil && !p.stopped && p.reply != "" && ss.expect.matches(p.reply)
+	if p.correct {
+		p.title += " ✓"
+	} else {
+		p.title += " ✗"
 	}
+	var out strings.Builder
+	drawTitle(p, &out)
+	fmt.Fprintf(&out, "\033[%d;1H", ss.statusR)
+	fmt.Print(out.String())
 }
 
-func (ss *splitScreen) redrawTemp() {
-	fmt.Print("\033[2J\033[H\033[?25l")
-	ss.drawTempBorders()
+// tally is the accuracy summary for the status line, "" when not judging.
+func (ss *splitScreen) tally() string {
+	if ss.expect == nil {
+		return ""
+	}
+	n := 0
+	for _, p := range ss.panels {
+		if p.correct {
+			n++
+		}
+	}
+	return fmt.Sprintf(ss.text("Верно: %d из %d (%.0f%%). ", "Correct: %d of %d (%.0f%%). "),
+		n, len(ss.panels), 100*float64(n)/float64(len(ss.panels)))
+}
 
-	ss.drawQuestion()
-	fmt.Printf("\033[%d;1H%s", ss.sepR, strings.Repeat("─", ss.termW))
+// ─── Temperature comparison ──────────────────────────────────────────────────
 
-	for i := 0; i < 3; i++ {
-		p := ss.panels[i]
-		content := p.buf.String()
-		p.cr, p.cc = 0, 0
-		p.lines = nil
-		p.curLine.Reset()
-		p.buf.Reset()
-		var out strings.Builder
-		ss.writeInto(p, content, &out)
-		fmt.Print(out.String())
-	}
-	fmt.Printf("\033[%d;1H", ss.statusR)
+func newTempScreen(question string) *splitScreen {
+	return newGridScreen(question, false, "temp=0", "temp=0.7", "temp=1.0")
 }
 
-func runTempComparison(apiKey string, cfg config, question string, scanner *bufio.Scanner) {
+// runTempComparison asks the question at three temperatures. It returns an
+// error only when every panel failed.
+func runTempComparison(apiKey string, cfg config, question string, in *bufio.Reader) error {
 	ss := newTempScreen(question)
+	ss.bell = cfg.bell
+	ss.failFast = cfg.failFast
+	ss.expect, _ = parseExpected(cfg.expected) // validated in parseArgs
 	defer ss.cleanup()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -577,224 +1699,183 @@ func runTempComparison(apiKey string, cfg config, question string, scanner *bufi
 	}()
 
 	temps := [3]float64{0, 0.7, 1.0}
+	for i := range temps {
+		ss.panels[i].config.temperature = &temps[i]
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(3)
-
-	for i := 0; i < 3; i++ {
-		go func(idx int) {
-			defer wg.Done()
-			p := ss.panels[idx]
-			tempCfg := cfg
-			tempCfg.temperature = temps[idx]
-			streamToPanel(ctx, apiKey, tempCfg,
+	jobs := make([]func(context.Context), len(ss.panels))
+	for i, p := range ss.panels {
+		jobs[i] = func(ctx context.Context) {
+			streamToPanel(ctx, apiKey, cfg,
 				[]message{{Role: "user", Content: question}},
 				ss, p)
-			ss.markDone()
-		}(i)
-	}
-
-	wg.Wait()
-
-	wasCancelled := ctx.Err() != nil
-	cancel()
-
-	for {
-		msg := "Готово! Введи 1-3 для просмотра панели, Enter для выхода в чат."
-		if wasCancelled {
-			msg = "Отменено. Введи 1-3 для просмотра панели, Enter для выхода в чат."
 		}
-		ss.setStatus(msg)
-		fmt.Print("\033[?25h")
-		scanner.Scan()
-		input := strings.TrimSpace(scanner.Text())
-
-		if input == "" {
-			break
-		}
-		if len(input) == 1 && input[0] >= '1' && input[0] <= '3' {
-			ss.viewPanel(int(input[0] - '1'))
-			scanner.Scan()
-			ss.redrawTemp()
-			fmt.Print("\033[?25l")
-		}
-	}
-
-	fmt.Print("\033[?25h")
-	_, h := termSize()
-	fmt.Printf("\033[%d;1H\n", h)
-}
-
-// ─── Model comparison ────────────────────────────────────────────────────────
-
-type metrics struct {
-	model        string
-	provider     string
-	duration     time.Duration
-	inputTokens  int
-	outputTokens int
-	costIn       float64
-	costOut      float64
-}
-
-func (m *metrics) totalCost() float64 {
-	return float64(m.inputTokens)*m.costIn/1e6 + float64(m.outputTokens)*m.costOut/1e6
-}
-
-func newModelScreen(question string) *splitScreen {
-	w, h := termSize()
-	third := w / 3
-
-	panelH := h - 6
-	if panelH < 3 {
-		panelH = 3
 	}
+	ss.streamPanels(ctx, jobs)
 
-	questR := panelH + 3
-	sepR := panelH + 5
-	statusR := panelH + 6
-
-	panels := [4]*panel{
-		{title: "Qwen2.5-1.5B (local)", color: "\033[94m", r0: 2, c0: 2, w: third - 1, h: panelH},
-		{title: "GPT-4o-mini", color: "\033[92m", r0: 2, c0: third + 2, w: third - 1, h: panelH},
-		{title: "Claude Sonnet", color: "\033[93m", r0: 2, c0: 2*third + 2, w: w - 2*third - 2, h: panelH},
-		{},
-	}
-
-	ss := &splitScreen{
-		panels: panels, panelCount: 3, termW: w, half: third, panelH: panelH,
-		midRow: 0, questR: questR, sepR: sepR, statusR: statusR,
-		question: question,
-	}
-
-	fmt.Print("\033[2J\033[H\033[?25l")
-	ss.drawModelBorders()
-
-	ss.drawQuestion()
-	fmt.Printf("\033[%d;1H%s", sepR, strings.Repeat("─", w))
-	fmt.Printf("\033[%d;1HStreaming from 3 models... (Ctrl+C to cancel)", statusR)
-
-	return ss
-}
-
-func (ss *splitScreen) drawModelBorders() {
-	w := ss.termW
-	third := ss.half
-	panelH := ss.panelH
-
-	h1 := strings.Repeat("─", third-1)
-	h2 := strings.Repeat("─", third-1)
-	h3 := strings.Repeat("─", w-2*third-2)
+	wasCancelled := ctx.Err() != nil
+	cancel()
 
-	fmt.Printf("\033[1;1H┌%s┬%s┬%s┐", h1, h2, h3)
-	for r := 2; r <= panelH+1; r++ {
-		fmt.Printf("\033[%d;1H│\033[%d;%dH│\033[%d;%dH│\033[%d;%dH│",
-			r, r, third+1, r, 2*third+1, r, w)
+	msg := "Готово! Введи 1-3 для просмотра панели, q — вопрос целиком, Enter — выход в чат."
+	if wasCancelled {
+		msg = "Отменено. Введи 1-3 для просмотра панели, q — вопрос целиком, Enter — выход в чат."
 	}
-	fmt.Printf("\033[%d;1H└%s┴%s┴%s┘", panelH+2, h1, h2, h3)
+	ss.navigate(in, func() string {
+		return ss.failNote() + ss.outcomes() + ss.tally() + ss.save(cfg.saveCmp, "temp", nil) + msg
+	})
 
-	titles := [3]struct{ col int; color, name string }{
-		{3, ss.panels[0].color, ss.panels[0].title},
-		{third + 3, ss.panels[1].color, ss.panels[1].title},
-		{2*third + 3, ss.panels[2].color, ss.panels[2].title},
-	}
-	for _, t := range titles {
-		fmt.Printf("\033[1;%dH%s %s \033[0m", t.col, t.color, t.name)
-	}
+	fmt.Print("\033[?25h")
+	_, h := termSize()
+	fmt.Printf("\033[%d;1H\n", h)
+	return ss.failure()
 }
 
-func (ss *splitScreen) redrawModel() {
-	fmt.Print("\033[2J\033[H\033[?25l")
-	ss.drawModelBorders()
+// ─── Model comparison ────────────────────────────────────────────────────────
 
-	ss.drawQuestion()
-	fmt.Printf("\033[%d;1H%s", ss.sepR, strings.Repeat("─", ss.termW))
+type metrics struct {
+	model        string
+	provider     string
+	duration     time.Duration
+	ttft         time.Duration // time to the first text token, 0 if none came
+	inputTokens  int
+	outputTokens int
+	costIn       float64
+	costOut      float64
+}
 
-	for i := 0; i < 3; i++ {
-		p := ss.panels[i]
-		content := p.buf.String()
-		p.cr, p.cc = 0, 0
-		p.lines = nil
-		p.curLine.Reset()
-		p.buf.Reset()
-		var out strings.Builder
-		ss.writeInto(p, content, &out)
-		fmt.Print(out.String())
+func (m *metrics) totalCost() float64 {
+	return float64(m.inputTokens)*m.costIn/1e6 + float64(m.outputTokens)*m.costOut/1e6
+}
+
+func newModelScreen(question string, models []modelInfo) *splitScreen {
+	titles := make([]string, len(models))
+	for i, mi := range models {
+		titles[i] = mi.name
 	}
-	fmt.Printf("\033[%d;1H", ss.statusR)
+	return newGridScreen(question, true, titles...)
 }
 
-func streamToPanelOpenAI(ctx context.Context, baseURL, apiKey, model string, cfg config, msgs []message, ss *splitScreen, p *panel) (string, *metrics, error) {
-	m := &metrics{model: model, costIn: 0, costOut: 0}
+func streamToPanelOpenAI(ctx context.Context, mi modelInfo, cfg config, msgs []message, ss sink, p *panel) (string, *metrics, error) {
+	cfg = p.config.apply(cfg)
+	p.reply = ""
+	m := &metrics{model: mi.model, costIn: 0, costOut: 0}
 	start := time.Now()
 
-	body, _ := json.Marshal(buildOpenAIRequest(model, cfg, msgs))
+	body, _ := json.Marshal(buildOpenAIRequest(mi.model, cfg, msgs))
 
-	req, err := http.NewRequestWithContext(ctx, "POST", baseURL+"/v1/chat/completions", bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", mi.endpoint(), bytes.NewReader(body))
 	if err != nil {
-		ss.write(p, "Error: "+err.Error())
+		ss.write(p, "Error: "+redact(err.Error()))
 		return "", m, err
 	}
-	if apiKey != "" {
-		req.Header.Set("Authorization", "Bearer "+apiKey)
-	}
+	mi.setAuth(req)
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := cfg.httpClient().Do(req)
 	if err != nil {
 		if ctx.Err() == nil {
-			ss.write(p, "Error: "+err.Error())
+			ss.write(p, "Error: "+redact(err.Error()))
 		}
 		m.duration = time.Since(start)
 		return "", m, err
 	}
 	defer resp.Body.Close()
+	if err := decodeBody(resp); err != nil {
+		ss.write(p, "Error: "+err.Error())
+		m.duration = time.Since(start)
+		return "", m, err
+	}
 
 	if resp.StatusCode != 200 {
 		b, _ := io.ReadAll(resp.Body)
-		ss.write(p, fmt.Sprintf("API error (%d): %s", resp.StatusCode, string(b)))
+		e := &apiError{resp.StatusCode, string(b), mi.keyEnv}
+		ss.write(p, redact(e.Error()))
 		m.duration = time.Since(start)
-		return "", m, fmt.Errorf("API error %d: %s", resp.StatusCode, b)
+		return "", m, e
 	}
 
 	var full strings.Builder
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		if ctx.Err() != nil {
-			break
-		}
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "[DONE]" {
-			break
+	deltas := 0 // each content delta is about one token
+	dropped := 0
+	var finish string   // finish_reason of the choice
+	var streamErr error // an error object streamed in place of a chunk
+	var thinking *thinkingBox
+	if cfg.thinking {
+		thinking = &thinkingBox{ss: ss, p: p}
+	}
+	ss.beginOutput(p)
+	err = readSSE(resp.Body, func(data string) bool {
+		if ctx.Err() != nil || data == "[DONE]" {
+			return false
 		}
 
 		var event struct {
 			Choices []struct {
 				Delta struct {
-					Content string `json:"content"`
+					Content          string `json:"content"`
+					ReasoningContent string `json:"reasoning_content"`
 				} `json:"delta"`
+				FinishReason string `json:"finish_reason"`
 			} `json:"choices"`
 			Usage *struct {
 				PromptTokens     int `json:"prompt_tokens"`
 				CompletionTokens int `json:"completion_tokens"`
 			} `json:"usage"`
+			Error *struct {
+				Message string `json:"message"`
+				Type    string `json:"type"`
+			} `json:"error"`
 		}
 		if err := json.Unmarshal([]byte(data), &event); err != nil {
-			continue
+			dropped++
+			reqLog.parseError(data, err)
+			return true
+		}
+		if event.Error != nil {
+			// Some servers (vLLM among them) report failures mid-stream
+			// rather than with an HTTP status.
+			streamErr = fmt.Errorf("stream error (%s): %s", event.Error.Type, event.Error.Message)
+			thinking.close()
+			ss.write(p, "\n"+redact(streamErr.Error()))
+			return false
+		}
+		if len(event.Choices) > 0 && event.Choices[0].FinishReason != "" {
+			finish = event.Choices[0].FinishReason
+		}
+		if len(event.Choices) > 0 && event.Choices[0].Delta.ReasoningContent != "" {
+			thinking.write(event.Choices[0].Delta.ReasoningContent)
 		}
 		if len(event.Choices) > 0 && event.Choices[0].Delta.Content != "" {
 			text := event.Choices[0].Delta.Content
+			thinking.close()
+			if full.Len() == 0 {
+				m.ttft = time.Since(start)
+			}
 			ss.write(p, text)
 			full.WriteString(text)
+			deltas++
+			ss.setOutput(p, deltas, false)
 		}
 		if event.Usage != nil {
 			m.inputTokens = event.Usage.PromptTokens
 			m.outputTokens = event.Usage.CompletionTokens
+			ss.setOutput(p, m.outputTokens, true)
 		}
+		return true
+	}, func() { ss.ping(p) })
+	thinking.close()
+	switch finish {
+	case "length":
+		ss.write(p, "\n[truncated (length)]")
+	case "content_filter":
+		ss.write(p, "\n[filtered]")
+	}
+	if note := droppedNote(cfg, dropped); note != "" {
+		ss.write(p, "\n"+note)
+	}
+	if err == nil {
+		err = streamErr
 	}
 
 	m.duration = time.Since(start)
@@ -804,116 +1885,447 @@ func streamToPanelOpenAI(ctx context.Context, baseURL, apiKey, model string, cfg
 		m.outputTokens = full.Len() / 4
 	}
 
-	return full.String(), m, scanner.Err()
+	p.reply = full.String()
+	return p.reply, m, err
 }
 
-func streamToPanelAnthropic(ctx context.Context, apiKey string, cfg config, msgs []message, ss *splitScreen, p *panel) (string, *metrics, error) {
-	m := &metrics{model: "claude-sonnet-4-5-20250929"}
+// streamToPanelGemini streams from Google's streamGenerateContent over SSE.
+func streamToPanelGemini(ctx context.Context, mi modelInfo, cfg config, msgs []message, ss sink, p *panel) (string, *metrics, error) {
+	cfg = p.config.apply(cfg)
+	p.reply = ""
+	m := &metrics{model: mi.model}
 	start := time.Now()
 
-	body, _ := json.Marshal(buildRequest(cfg, msgs))
+	body, _ := json.Marshal(buildGeminiRequest(cfg, msgs))
 
-	req, err := http.NewRequestWithContext(ctx, "POST", "https://api.anthropic.com/v1/messages", bytes.NewReader(body))
+	endpoint := mi.baseURL + "/v1beta/models/" + url.PathEscape(mi.model) + ":streamGenerateContent?alt=sse"
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
 	if err != nil {
-		ss.write(p, "Error: "+err.Error())
+		ss.write(p, "Error: "+redact(err.Error()))
 		return "", m, err
 	}
-	req.Header.Set("x-api-key", apiKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
-	req.Header.Set("content-type", "application/json")
+	req.Header.Set("x-goog-api-key", mi.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := cfg.httpClient().Do(req)
 	if err != nil {
 		if ctx.Err() == nil {
-			ss.write(p, "Error: "+err.Error())
+			ss.write(p, "Error: "+redact(err.Error()))
 		}
 		m.duration = time.Since(start)
 		return "", m, err
 	}
 	defer resp.Body.Close()
+	if err := decodeBody(resp); err != nil {
+		ss.write(p, "Error: "+err.Error())
+		m.duration = time.Since(start)
+		return "", m, err
+	}
 
 	if resp.StatusCode != 200 {
 		b, _ := io.ReadAll(resp.Body)
-		ss.write(p, fmt.Sprintf("API error (%d)", resp.StatusCode))
+		e := &apiError{resp.StatusCode, string(b), mi.keyEnv}
+		ss.write(p, redact(e.Error()))
 		m.duration = time.Since(start)
-		return "", m, fmt.Errorf("API error %d: %s", resp.StatusCode, b)
+		return "", m, e
 	}
 
 	var full strings.Builder
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
+	chars, dropped := 0, 0
+	ss.beginOutput(p)
+	err = readSSE(resp.Body, func(data string) bool {
 		if ctx.Err() != nil {
-			break
-		}
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "[DONE]" {
-			break
+			return false
 		}
 
-		var raw json.RawMessage
 		var event struct {
-			Type string `json:"type"`
+			Candidates []struct {
+				Content struct {
+					Parts []struct {
+						Text string `json:"text"`
+					} `json:"parts"`
+				} `json:"content"`
+				FinishReason string `json:"finishReason"`
+			} `json:"candidates"`
+			UsageMetadata *struct {
+				PromptTokenCount     int `json:"promptTokenCount"`
+				CandidatesTokenCount int `json:"candidatesTokenCount"`
+			} `json:"usageMetadata"`
 		}
-		if err := json.Unmarshal([]byte(data), &raw); err != nil {
-			continue
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			dropped++
+			reqLog.parseError(data, err)
+			return true
 		}
-		if err := json.Unmarshal(raw, &event); err != nil {
-			continue
+		finished := false
+		if len(event.Candidates) > 0 {
+			for _, part := range event.Candidates[0].Content.Parts {
+				if part.Text == "" {
+					continue
+				}
+				if full.Len() == 0 {
+					m.ttft = time.Since(start)
+				}
+				ss.write(p, part.Text)
+				full.WriteString(part.Text)
+				chars += utf8.RuneCountInString(part.Text)
+				ss.setOutput(p, chars/4, false)
+			}
+			finished = event.Candidates[0].FinishReason != ""
+		}
+		// Usage comes cumulatively on every chunk; it is final with the finish reason.
+		if u := event.UsageMetadata; u != nil {
+			m.inputTokens = u.PromptTokenCount
+			m.outputTokens = u.CandidatesTokenCount
+			if finished {
+				ss.setOutput(p, m.outputTokens, true)
+			}
+		}
+		return true
+	}, func() { ss.ping(p) })
+	if note := droppedNote(cfg, dropped); note != "" {
+		ss.write(p, "\n"+note)
+	}
+
+	m.duration = time.Since(start)
+	if m.outputTokens == 0 && full.Len() > 0 {
+		m.outputTokens = full.Len() / 4
+	}
+
+	p.reply = full.String()
+	return p.reply, m, err
+}
+
+func streamToPanelAnthropic(ctx context.Context, apiKey string, cfg config, msgs []message, ss sink, p *panel) (string, *metrics, error) {
+	cfg = p.config.apply(cfg)
+	p.reply = ""
+	m := &metrics{model: cfg.model}
+	start := time.Now()
+
+	body, _ := json.Marshal(buildRequest(cfg, msgs))
+
+	req, err := http.NewRequestWithContext(ctx, "POST", anthropicMessagesURL(cfg), bytes.NewReader(body))
+	if err != nil {
+		ss.write(p, "Error: "+redact(err.Error()))
+		return "", m, err
+	}
+	setAnthropicHeaders(req, apiKey, cfg)
+
+	resp, err := cfg.httpClient().Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			ss.write(p, "Error: "+redact(err.Error()))
 		}
+		m.duration = time.Since(start)
+		return "", m, err
+	}
+	defer resp.Body.Close()
+	if err := decodeBody(resp); err != nil {
+		ss.write(p, "Error: "+err.Error())
+		m.duration = time.Since(start)
+		return "", m, err
+	}
+
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		e := &apiError{resp.StatusCode, string(b), "ANTHROPIC_API_KEY"}
+		ss.write(p, redact(e.Error()))
+		m.duration = time.Since(start)
+		return "", m, e
+	}
 
-		switch event.Type {
-		case "message_start":
-			var ms struct {
-				Message struct {
-					Usage struct {
-						InputTokens int `json:"input_tokens"`
-					} `json:"usage"`
-				} `json:"message"`
+	var full strings.Builder
+	chars, dropped := 0, 0
+	ss.beginOutput(p)
+	err = parseAnthropicStream(resp.Body,
+		func(text string) {
+			if ctx.Err() != nil {
+				return
+			}
+			if full.Len() == 0 {
+				m.ttft = time.Since(start)
+			}
+			ss.write(p, text)
+			full.WriteString(text)
+			chars += utf8.RuneCountInString(text)
+			ss.setOutput(p, chars/4, false)
+		},
+		func(u usage) {
+			m.inputTokens = u.inputTokens
+			m.outputTokens = u.outputTokens
+			dropped = u.dropped
+			if u.stopReason != "" {
+				ss.setOutput(p, u.outputTokens, true)
 			}
-			json.Unmarshal(raw, &ms)
-			m.inputTokens = ms.Message.Usage.InputTokens
+		},
+		func(err error) { ss.write(p, "\n"+redact(err.Error())) },
+		func() { ss.ping(p) })
+	if note := droppedNote(cfg, dropped); note != "" {
+		ss.write(p, "\n"+note)
+	}
+	if ctx.Err() != nil {
+		err = nil // cancelled, not a read error
+	}
 
-		case "content_block_delta":
-			var cbd struct {
-				Delta struct {
-					Type string `json:"type"`
-					Text string `json:"text"`
-				} `json:"delta"`
+	m.duration = time.Since(start)
+	p.reply = full.String()
+	return p.reply, m, err
+}
+
+// sink receives a panel's streamed output: the split screen, or discard
+// for headless runs.
+type sink interface {
+	write(p *panel, text string)
+	setGutter(p *panel, gutter string)
+	beginOutput(p *panel)
+	setOutput(p *panel, n int, exact bool)
+	ping(p *panel)
+}
+
+type discard struct{}
+
+func (discard) write(*panel, string)        {}
+func (discard) setGutter(*panel, string)    {}
+func (discard) beginOutput(*panel)          {}
+func (discard) setOutput(*panel, int, bool) {}
+func (discard) ping(*panel)                 {}
+
+// thinkingBox shows a reasoning model's thinking in a box at the top of its
+// panel, the way the meta-prompt panel boxes its generated prompt, and closes
+// the box when the answer starts. Methods on a nil box do nothing, which is
+// how --thinking off drops the reasoning.
+type thinkingBox struct {
+	ss   sink
+	p    *panel
+	open bool
+	last string // the latest reasoning chunk, to end the box on a new line
+}
+
+func (t *thinkingBox) write(text string) {
+	if t == nil {
+		return
+	}
+	if !t.open {
+		t.ss.write(t.p, "┌─ Reasoning\n")
+		t.ss.setGutter(t.p, "│ ")
+		t.open = true
+	}
+	t.ss.write(t.p, text)
+	t.last = text
+}
+
+func (t *thinkingBox) close() {
+	if t == nil || !t.open {
+		return
+	}
+	if !strings.HasSuffix(t.last, "\n") {
+		t.ss.write(t.p, "\n")
+	}
+	t.ss.setGutter(t.p, "")
+	t.ss.write(t.p, "└─\n\n")
+	t.open = false
+}
+
+// comparisonModels is the --lineup when one was given, otherwise the
+// weak/medium/strong lineup plus Gemini when GEMINI_API_KEY is set.
+func comparisonModels(anthropicKey, openaiKey, lineup string) []modelInfo {
+	if lineup != "" {
+		models, _ := lineupModels(lineup) // validated in parseArgs
+		return models
+	}
+	models := []modelInfo{
+		{name: "Qwen2.5-1.5B (local)", provider: "Local", baseURL: "http://localhost:1234", model: "qwen2.5-coder-1.5b-instruct", costIn: 0, costOut: 0},
+		{name: "GPT-4o-mini", provider: "OpenAI", baseURL: baseURLFromEnv("OPENAI_BASE_URL", "https://api.openai.com"), apiKey: openaiKey, keyEnv: "OPENAI_API_KEY", model: "gpt-4o-mini", costIn: 0.15, costOut: 0.60},
+		{name: "Claude Sonnet", provider: "Anthropic", apiKey: anthropicKey, keyEnv: "ANTHROPIC_API_KEY", model: "claude-sonnet-4-5-20250929", costIn: 3.00, costOut: 15.00},
+	}
+	if key := getenv("GEMINI_API_KEY"); key != "" {
+		addSecret(key)
+		models = append(models, modelInfo{name: "Gemini 2.5 Flash", provider: "Gemini", baseURL: "https://generativelanguage.googleapis.com", apiKey: key, keyEnv: "GEMINI_API_KEY", model: "gemini-2.5-flash", costIn: 0.30, costOut: 2.50})
+	}
+	return models
+}
+
+// ─── Provider catalog ────────────────────────────────────────────────────────
+
+// catalogEntry describes a provider --lineup can name. The first model is
+// the default; prices are USD per 1M input/output tokens.
+type catalogEntry struct {
+	provider string // Anthropic, Gemini, or anything else for OpenAI-compatible
+	baseURL  string
+	keyEnv   string // env var holding the API key, "" for none
+	baseEnv  string // env var that overrides baseURL, "" for none
+	models   []catalogModel
+
+	// OpenAI-compatible endpoint details, copied into modelInfo; "" for
+	// vanilla OpenAI.
+	path, authHeader, authFormat string
+}
+
+type catalogModel struct {
+	alias, id       string
+	costIn, costOut float64
+}
+
+// catalogPrice looks up the USD per 1M input/output tokens of a model id.
+func catalogPrice(model string) (costIn, costOut float64, ok bool) {
+	for _, entry := range providerCatalog {
+		for _, cm := range entry.models {
+			if cm.id == model {
+				return cm.costIn, cm.costOut, true
 			}
-			json.Unmarshal(raw, &cbd)
-			if cbd.Delta.Type == "text_delta" {
-				ss.write(p, cbd.Delta.Text)
-				full.WriteString(cbd.Delta.Text)
+		}
+	}
+	return 0, 0, false
+}
+
+// anthropicModel resolves a chat model name: a catalog alias (haiku) or id,
+// or any other claude-… id as given.
+func anthropicModel(name string) (string, bool) {
+	for _, cm := range providerCatalog["anthropic"].models {
+		if strings.EqualFold(name, cm.alias) || name == cm.id {
+			return cm.id, true
+		}
+	}
+	return name, strings.HasPrefix(name, "claude")
+}
+
+// modelAlias is the catalog alias of a model id, or the id itself.
+func modelAlias(model string) string {
+	for _, entry := range providerCatalog {
+		for _, cm := range entry.models {
+			if cm.id == model {
+				return cm.alias
 			}
+		}
+	}
+	return model
+}
+
+var providerCatalog = map[string]catalogEntry{
+	"anthropic": {provider: "Anthropic", keyEnv: "ANTHROPIC_API_KEY", models: []catalogModel{
+		{"sonnet", "claude-sonnet-4-5-20250929", 3.00, 15.00},
+		{"haiku", "claude-haiku-4-5-20251001", 1.00, 5.00},
+		{"opus", "claude-opus-4-1-20250805", 15.00, 75.00},
+	}},
+	"openai": {provider: "OpenAI", baseURL: "https://api.openai.com", keyEnv: "OPENAI_API_KEY", baseEnv: "OPENAI_BASE_URL", models: []catalogModel{
+		{"gpt-4o-mini", "gpt-4o-mini", 0.15, 0.60},
+		{"gpt-4o", "gpt-4o", 2.50, 10.00},
+		{"gpt-4.1-mini", "gpt-4.1-mini", 0.40, 1.60},
+	}},
+	"gemini": {provider: "Gemini", baseURL: "https://generativelanguage.googleapis.com", keyEnv: "GEMINI_API_KEY", models: []catalogModel{
+		{"flash", "gemini-2.5-flash", 0.30, 2.50},
+		{"pro", "gemini-2.5-pro", 1.25, 10.00},
+	}},
+	"groq": {provider: "Groq", baseURL: "https://api.groq.com/openai", keyEnv: "GROQ_API_KEY", models: []catalogModel{
+		{"llama-3.3-70b", "llama-3.3-70b-versatile", 0.59, 0.79},
+		{"llama-3.1-8b", "llama-3.1-8b-instant", 0.05, 0.08},
+	}},
+	"mistral": {provider: "Mistral", baseURL: "https://api.mistral.ai", keyEnv: "MISTRAL_API_KEY", models: []catalogModel{
+		{"small", "mistral-small-latest", 0.10, 0.30},
+		{"large", "mistral-large-latest", 2.00, 6.00},
+	}},
+	"together": {provider: "Together", baseURL: "https://api.together.xyz", keyEnv: "TOGETHER_API_KEY", models: []catalogModel{
+		{"llama-3.3-70b", "meta-llama/Llama-3.3-70B-Instruct-Turbo", 0.88, 0.88},
+		{"qwen-2.5-72b", "Qwen/Qwen2.5-72B-Instruct-Turbo", 1.20, 1.20},
+	}},
+	// Azure OpenAI takes the deployment name as the model, under the
+	// resource endpoint, with the key in an api-key header.
+	"azure": {provider: "Azure", keyEnv: "AZURE_OPENAI_API_KEY", baseEnv: "AZURE_OPENAI_ENDPOINT", models: []catalogModel{
+		{"gpt-4o-mini", "gpt-4o-mini", 0.15, 0.60},
+		{"gpt-4o", "gpt-4o", 2.50, 10.00},
+	}, path: "/openai/deployments/{model}/chat/completions?api-version=2024-10-21", authHeader: "api-key", authFormat: "%s"},
+	"local": {provider: "Local", baseURL: "http://localhost:1234", models: []catalogModel{
+		{"qwen2.5-1.5b", "qwen2.5-coder-1.5b-instruct", 0, 0},
+	}},
+}
 
-		case "message_delta":
-			var md struct {
-				Usage struct {
-					OutputTokens int `json:"output_tokens"`
-				} `json:"usage"`
+// lineupModels expands a --lineup such as "groq:llama-3.3-70b,openai,anthropic:sonnet".
+// A missing model is the provider's default; a model the catalog doesn't
+// know is sent as is, with unknown (zero) prices.
+func lineupModels(spec string) ([]modelInfo, error) {
+	var models []modelInfo
+	for item := range strings.SplitSeq(spec, ",") {
+		name, model, _ := strings.Cut(strings.TrimSpace(item), ":")
+		entry, ok := providerCatalog[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("--lineup: unknown provider %q (available: %s)", name, strings.Join(slices.Sorted(maps.Keys(providerCatalog)), ", "))
+		}
+		cm := entry.models[0]
+		if model != "" {
+			cm = catalogModel{alias: model, id: model}
+			for _, known := range entry.models {
+				if model == known.alias || model == known.id {
+					cm = known
+				}
 			}
-			json.Unmarshal(raw, &md)
-			m.outputTokens = md.Usage.OutputTokens
 		}
+		mi := modelInfo{
+			name: strings.ToLower(name) + ":" + cm.alias, provider: entry.provider,
+			baseURL: entry.baseURL, model: cm.id, costIn: cm.costIn, costOut: cm.costOut,
+			path: entry.path, authHeader: entry.authHeader, authFormat: entry.authFormat,
+		}
+		if entry.baseEnv != "" {
+			mi.baseURL = baseURLFromEnv(entry.baseEnv, entry.baseURL)
+		}
+		if entry.keyEnv != "" {
+			mi.apiKey, mi.keyEnv = getenv(entry.keyEnv), entry.keyEnv
+			addSecret(mi.apiKey)
+		}
+		models = append(models, mi)
+	}
+	if len(models) > len(activeTheme.panels) {
+		return nil, fmt.Errorf("--lineup: at most %d models, got %d", len(activeTheme.panels), len(models))
 	}
+	return models, nil
+}
 
-	m.duration = time.Since(start)
-	return full.String(), m, scanner.Err()
+// runModel asks one model the question, streaming into p through ss, and
+// returns its metrics labelled with the model's name and prices.
+func runModel(ctx context.Context, mi modelInfo, cfg config, question string, ss sink, p *panel) (*metrics, error) {
+	p.config = panelConfig{model: mi.model, maxTokens: mi.maxTokens, temperature: mi.temperature}
+	msgs := []message{{Role: "user", Content: question}}
+
+	var m *metrics
+	var err error
+	switch mi.provider {
+	case "Anthropic":
+		_, m, err = streamToPanelAnthropic(ctx, mi.apiKey, cfg, msgs, ss, p)
+	case "Gemini":
+		_, m, err = streamToPanelGemini(ctx, mi, cfg, msgs, ss, p)
+	default: // OpenAI-compatible
+		_, m, err = streamToPanelOpenAI(ctx, mi, cfg, msgs, ss, p)
+	}
+	p.noteErr(ctx, err)
+
+	if m != nil {
+		m.model = mi.name
+		m.provider = mi.provider
+		m.costIn = mi.costIn
+		m.costOut = mi.costOut
+		cfg.ledger.addMetrics(m)
+	}
+	return m, err
 }
 
-func printComparisonTable(results [3]*metrics) {
+// printComparisonTable prints one row per model. With repeated runs it
+// switches to timing statistics across the runs.
+func printComparisonTable(runs [][]*metrics) {
+	for _, ms := range runs {
+		if len(ms) > 1 {
+			printRepeatTable(runs)
+			return
+		}
+	}
 	fmt.Println()
 	fmt.Println("┌───────────────────────┬──────────┬────────────┬─────────────┬───────────┐")
 	fmt.Println("│ Model                 │ Time     │ Tokens I/O │ Cost        │ Provider  │")
 	fmt.Println("├───────────────────────┼──────────┼────────────┼─────────────┼───────────┤")
-	for _, m := range results {
-		if m == nil {
+	for _, ms := range runs {
+		if len(ms) == 0 || ms[0] == nil {
 			continue
 		}
+		m := ms[0]
 		name := m.model
 		if len(name) > 21 {
 			name = name[:21]
@@ -927,8 +2339,82 @@ func printComparisonTable(results [3]*metrics) {
 	fmt.Println()
 }
 
-func runModelComparison(anthropicKey, openaiKey string, cfg config, question string, scanner *bufio.Scanner) {
-	ss := newModelScreen(question)
+// printRepeatTable prints mean/median/stddev of duration and time to first
+// token per model, mean tokens and the total cost of all runs. Runs that
+// produced no text count toward the cost only.
+func printRepeatTable(runs [][]*metrics) {
+	fmt.Println()
+	fmt.Println("┌───────────────────────┬───────┬─────────────────────────┬─────────────────────────┬────────────┬─────────────┐")
+	fmt.Println("│ Model                 │ OK    │ Time mean/median/sd     │ TTFT mean/median/sd     │ Tokens I/O │ Total cost  │")
+	fmt.Println("├───────────────────────┼───────┼─────────────────────────┼─────────────────────────┼────────────┼─────────────┤")
+	for _, ms := range runs {
+		var durations, ttfts []time.Duration
+		var in, out int
+		var cost float64
+		var name string
+		for _, m := range ms {
+			if m == nil {
+				continue
+			}
+			name = m.model
+			cost += m.totalCost()
+			if m.ttft == 0 {
+				continue // failed or empty run: no timings to speak of
+			}
+			durations = append(durations, m.duration)
+			ttfts = append(ttfts, m.ttft)
+			in += m.inputTokens
+			out += m.outputTokens
+		}
+		if name == "" {
+			continue
+		}
+		if len(name) > 21 {
+			name = name[:21]
+		}
+		n := len(durations)
+		tokens := "-"
+		if n > 0 {
+			tokens = fmt.Sprintf("%d/%d", in/n, out/n)
+		}
+		fmt.Printf("│ %-21s │ %-5s │ %-23s │ %-23s │ %-10s │ $%-10.6f │\n",
+			name, fmt.Sprintf("%d/%d", n, len(ms)), formatStats(durations), formatStats(ttfts), tokens, cost)
+	}
+	fmt.Println("└───────────────────────┴───────┴─────────────────────────┴─────────────────────────┴────────────┴─────────────┘")
+	fmt.Println()
+}
+
+// formatStats renders "mean / median / stddev" in seconds, or "-" for no samples.
+func formatStats(ds []time.Duration) string {
+	if len(ds) == 0 {
+		return "-"
+	}
+	sorted := slices.Sorted(slices.Values(ds))
+	var sum float64
+	for _, d := range ds {
+		sum += d.Seconds()
+	}
+	mean := sum / float64(len(ds))
+	median := sorted[len(sorted)/2].Seconds()
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1].Seconds() + median) / 2
+	}
+	var sq float64
+	for _, d := range ds {
+		sq += (d.Seconds() - mean) * (d.Seconds() - mean)
+	}
+	sd := math.Sqrt(sq / float64(len(ds)))
+	return fmt.Sprintf("%.2fs / %.2fs / %.2fs", mean, median, sd)
+}
+
+// runModelComparison asks each model of the lineup the question and prints
+// the comparison table. It returns an error only when every panel failed.
+func runModelComparison(anthropicKey, openaiKey string, cfg config, question string, in *bufio.Reader) error {
+	models := comparisonModels(anthropicKey, openaiKey, cfg.lineup)
+	ss := newModelScreen(question, models)
+	ss.bell = cfg.bell
+	ss.failFast = cfg.failFast
+	ss.expect, _ = parseExpected(cfg.expected) // validated in parseArgs
 	defer ss.cleanup()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -945,74 +2431,281 @@ func runModelComparison(anthropicKey, openaiKey string, cfg config, question str
 		signal.Stop(sigCh)
 	}()
 
-	models := [3]modelInfo{
-		{name: "Qwen2.5-1.5B (local)", provider: "Local", baseURL: "http://localhost:1234", model: "qwen2.5-coder-1.5b-instruct", costIn: 0, costOut: 0},
-		{name: "GPT-4o-mini", provider: "OpenAI", baseURL: "https://api.openai.com", apiKey: openaiKey, model: "gpt-4o-mini", costIn: 0.15, costOut: 0.60},
-		{name: "Claude Sonnet", provider: "Anthropic", apiKey: anthropicKey, model: "claude-sonnet-4-5-20250929", costIn: 3.00, costOut: 15.00},
+	// With --repeat each panel shows only its latest run; the metrics of
+	// every run are kept for the table.
+	runs := make([][]*metrics, len(models))
+	results := make([]*metrics, len(models))
+	var mu sync.Mutex
+	jobs := make([]func(context.Context), len(ss.panels))
+	for i, p := range ss.panels {
+		jobs[i] = func(ctx context.Context) {
+			mu.Lock()
+			runs[i] = nil // a retry starts the model's runs over
+			mu.Unlock()
+			for run := range cfg.repeat {
+				if ctx.Err() != nil {
+					return
+				}
+				if cfg.repeat > 1 {
+					if run > 0 {
+						ss.resetPanel(p)
+					}
+					ss.setTitle(p, fmt.Sprintf("%s · %d/%d", models[i].name, run+1, cfg.repeat))
+				}
+				m, _ := runModel(ctx, models[i], cfg, question, ss, p)
+				mu.Lock()
+				results[i] = m
+				if m != nil {
+					runs[i] = append(runs[i], m)
+				}
+				mu.Unlock()
+			}
+		}
 	}
+	ss.streamPanels(ctx, jobs)
 
-	var results [3]*metrics
-	var mu sync.Mutex
-	var wg sync.WaitGroup
-	wg.Add(3)
+	wasCancelled := ctx.Err() != nil
+	cancel()
 
-	for i := 0; i < 3; i++ {
-		go func(idx int) {
-			defer wg.Done()
-			p := ss.panels[idx]
-			mi := models[idx]
-			msgs := []message{{Role: "user", Content: question}}
+	msg := fmt.Sprintf("Done! Press 1-%d to view panel, q for the full question, Enter to see comparison table.", len(models))
+	if wasCancelled {
+		msg = fmt.Sprintf("Cancelled. Press 1-%d to view panel, q for the full question, Enter to see comparison table.", len(models))
+	}
+	more := ss.navigate(in, func() string {
+		return ss.failNote() + ss.outcomes() + ss.tally() + ss.save(cfg.saveCmp, "models", results) + msg
+	})
 
-			var m *metrics
-			if mi.provider == "Anthropic" {
-				_, m, _ = streamToPanelAnthropic(ctx, mi.apiKey, cfg, msgs, ss, p)
-			} else {
-				_, m, _ = streamToPanelOpenAI(ctx, mi.baseURL, mi.apiKey, mi.model, cfg, msgs, ss, p)
-			}
+	// Show comparison table after exiting split view
+	if more {
+		fmt.Print("\033[?25h\033[2J\033[H")
+	} else {
+		_, h := termSize()
+		fmt.Printf("\033[%d;1H\n", h)
+	}
+	fmt.Printf("Question: %s\n", question)
+	printComparisonTable(runs)
+	if more {
+		fmt.Println("Press Enter to continue...")
+		readLine(in)
+	}
+	return ss.failure()
+}
+
+// ─── Batch mode ──────────────────────────────────────────────────────────────
+
+// runBatch runs the model comparison headlessly on every non-empty line of
+// cfg.batch and appends one CSV row per model and question to
+// cfg.metricsOut (stdout when unset). Progress goes to stderr.
+func runBatch(anthropicKey, openaiKey string, cfg config) error {
+	data, err := os.ReadFile(cfg.batch)
+	if err != nil {
+		return err
+	}
+	var questions []string
+	for line := range strings.Lines(string(data)) {
+		if q := strings.TrimSpace(line); q != "" && !strings.HasPrefix(q, "#") {
+			questions = append(questions, q)
+		}
+	}
+	if len(questions) == 0 {
+		return fmt.Errorf("%s: no questions", cfg.batch)
+	}
 
-			if m != nil {
-				m.model = mi.name
-				m.provider = mi.provider
-				m.costIn = mi.costIn
-				m.costOut = mi.costOut
+	out := os.Stdout
+	if cfg.metricsOut != "" {
+		out, err = os.OpenFile(cfg.metricsOut, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	w := csv.NewWriter(out)
+	if info, err := out.Stat(); err != nil || info.Size() == 0 {
+		w.Write([]string{"question", "model", "provider", "duration_ms", "input_tokens", "output_tokens", "cost_usd", "error"})
+	}
+
+	interrupted, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, stopAll := context.WithCancel(interrupted)
+	defer stopAll()
+
+	models := comparisonModels(anthropicKey, openaiKey, cfg.lineup)
+	var failed atomic.Int32
+	var firstErr error // the failure that stopped the batch under --fail-fast
+	var once sync.Once
+	for n, question := range questions {
+		batchProgress(n, len(questions))
+		rows := make([][]string, len(models))
+		var wg sync.WaitGroup
+		for i, mi := range models {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m, err := runModel(ctx, mi, cfg, question, discard{}, &panel{})
+				if err != nil && ctx.Err() != nil {
+					return // cancelled; no row
+				}
+				if m == nil {
+					m = &metrics{model: mi.name, provider: mi.provider}
+				}
+				errText := ""
+				if err != nil {
+					failed.Add(1)
+					errText = redact(err.Error())
+					if cfg.failFast {
+						once.Do(func() {
+							firstErr = fmt.Errorf("%s on %q: %w", mi.name, question, err)
+							stopAll()
+						})
+					}
+				}
+				rows[i] = []string{question, m.model, m.provider,
+					strconv.FormatInt(m.duration.Milliseconds(), 10),
+					strconv.Itoa(m.inputTokens), strconv.Itoa(m.outputTokens),
+					fmt.Sprintf("%.6f", m.totalCost()), errText}
+			}()
+		}
+		wg.Wait()
+		if firstErr != nil {
+			// Keep the rows that finished, including the one that failed.
+			for _, row := range rows {
+				if row != nil {
+					w.Write(row)
+				}
 			}
-			mu.Lock()
-			results[idx] = m
-			mu.Unlock()
-			ss.markDone()
-		}(i)
+			fmt.Fprintln(os.Stderr)
+			w.Flush()
+			return firstErr
+		}
+		if ctx.Err() != nil {
+			fmt.Fprintln(os.Stderr)
+			w.Flush()
+			return fmt.Errorf("interrupted after %d of %d questions", n, len(questions))
+		}
+		for _, row := range rows {
+			w.Write(row)
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
 	}
+	batchProgress(len(questions), len(questions))
+	fmt.Fprintln(os.Stderr)
+	if n := int(failed.Load()); n > 0 {
+		return &partialError{n, len(questions) * len(models)}
+	}
+	return nil
+}
 
-	wg.Wait()
+// batchProgress redraws the progress bar on stderr.
+func batchProgress(done, total int) {
+	const width = 30
+	filled := done * width / total
+	fmt.Fprintf(os.Stderr, "\r[%s%s] %d/%d", strings.Repeat("█", filled), strings.Repeat("░", width-filled), done, total)
+}
 
-	wasCancelled := ctx.Err() != nil
-	cancel()
+// ─── Saved comparisons ───────────────────────────────────────────────────────
 
-	for {
-		msg := "Done! Press 1-3 to view panel, Enter to see comparison table."
-		if wasCancelled {
-			msg = "Cancelled. Press 1-3 to view panel, Enter to see comparison table."
-		}
-		ss.setStatus(msg)
-		fmt.Print("\033[?25h")
-		scanner.Scan()
-		input := strings.TrimSpace(scanner.Text())
+// cmpRecord is a finished comparison as saved by --save-cmp (.cmp.json).
+type cmpRecord struct {
+	Mode     string        `json:"mode"` // compare, temp or models
+	Question string        `json:"question"`
+	Panels   []panelRecord `json:"panels"`
+}
 
-		if input == "" {
-			break
+type panelRecord struct {
+	Title        string         `json:"title"`
+	Text         string         `json:"text"`
+	OutputTokens int            `json:"outputTokens"`
+	Metrics      *metricsRecord `json:"metrics,omitempty"`
+}
+
+type metricsRecord struct {
+	Model        string  `json:"model"`
+	Provider     string  `json:"provider"`
+	DurationMS   int64   `json:"durationMs"`
+	TTFTMS       int64   `json:"ttftMs"`
+	InputTokens  int     `json:"inputTokens"`
+	OutputTokens int     `json:"outputTokens"`
+	CostIn       float64 `json:"costIn"`  // per 1M input tokens
+	CostOut      float64 `json:"costOut"` // per 1M output tokens
+}
+
+// save writes the finished comparison to path (if set) and returns a short
+// note for the status line.
+func (ss *splitScreen) save(path, mode string, results []*metrics) string {
+	if path == "" {
+		return ""
+	}
+	rec := cmpRecord{Mode: mode, Question: ss.question}
+	for i, p := range ss.panels {
+		pr := panelRecord{Title: p.title, Text: p.buf.String(), OutputTokens: p.tokens}
+		if i < len(results) && results[i] != nil {
+			m := results[i]
+			pr.Metrics = &metricsRecord{
+				Model: m.model, Provider: m.provider, DurationMS: m.duration.Milliseconds(), TTFTMS: m.ttft.Milliseconds(),
+				InputTokens: m.inputTokens, OutputTokens: m.outputTokens, CostIn: m.costIn, CostOut: m.costOut,
+			}
 		}
-		if len(input) == 1 && input[0] >= '1' && input[0] <= '3' {
-			ss.viewPanel(int(input[0] - '1'))
-			scanner.Scan()
-			ss.redrawModel()
-			fmt.Print("\033[?25l")
+		rec.Panels = append(rec.Panels, pr)
+	}
+	data, _ := json.MarshalIndent(rec, "", "  ")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return ss.text("Не сохранено: ", "Not saved: ") + err.Error() + ". "
+	}
+	return ss.text("Сохранено в ", "Saved to ") + path + ". "
+}
+
+// runReplay reopens a saved comparison in its original layout, without any
+// API calls.
+func runReplay(path string, in *bufio.Reader) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var rec cmpRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if rec.Mode != "compare" && rec.Mode != "temp" && rec.Mode != "models" {
+		return fmt.Errorf("%s: unknown mode %q", path, rec.Mode)
+	}
+	if len(rec.Panels) == 0 || len(rec.Panels) > len(activeTheme.panels) {
+		return fmt.Errorf("%s: %d panels saved, can show 1 to %d", path, len(rec.Panels), len(activeTheme.panels))
+	}
+	titles := make([]string, len(rec.Panels))
+	for i, pr := range rec.Panels {
+		titles[i] = pr.Title
+	}
+	ss := newGridScreen(rec.Question, rec.Mode == "models", titles...)
+	defer ss.cleanup()
+
+	ss.doneCount = len(ss.panels)
+	runs := make([][]*metrics, len(rec.Panels))
+	for i, pr := range rec.Panels {
+		p := ss.panels[i]
+		p.tokens, p.exact = pr.OutputTokens, true
+		p.buf.WriteString(pr.Text)
+		if m := pr.Metrics; m != nil {
+			runs[i] = []*metrics{{
+				model: m.Model, provider: m.Provider, duration: time.Duration(m.DurationMS) * time.Millisecond, ttft: time.Duration(m.TTFTMS) * time.Millisecond,
+				inputTokens: m.InputTokens, outputTokens: m.OutputTokens, costIn: m.CostIn, costOut: m.CostOut,
+			}}
 		}
 	}
+	ss.redraw() // lays the saved buffers out again through writeInto
+
+	ss.navigate(in, func() string {
+		return ss.text(
+			"Повтор "+path+". Введи номер панели для просмотра, q — вопрос целиком, Enter — выход.",
+			"Replaying "+path+". Press a panel number to view it, q for the full question, Enter to quit.")
+	})
 
-	// Show comparison table after exiting split view
 	fmt.Print("\033[?25h\033[2J\033[H")
-	fmt.Printf("Question: %s\n", question)
-	printComparisonTable(results)
-	fmt.Println("Press Enter to continue...")
-	scanner.Scan()
+	if rec.Mode == "models" {
+		fmt.Printf("Question: %s\n", rec.Question)
+		printComparisonTable(runs)
+	}
+	return nil
 }
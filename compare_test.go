@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// grid is a virtual terminal for panel tests: it follows cursor moves
+// (ESC[r;cH), ignores every other escape sequence and keeps what is printed.
+type grid [][]rune
+
+func newGrid(rows, cols int) grid {
+	g := make(grid, rows)
+	for i := range g {
+		g[i] = []rune(strings.Repeat(" ", cols))
+	}
+	return g
+}
+
+func (g grid) apply(s string) {
+	r, c := 1, 1
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == '\033' && i+1 < len(runes) && runes[i+1] == '[' {
+			j := i + 2
+			for j < len(runes) && (runes[j] < '@' || runes[j] > '~') {
+				j++
+			}
+			if j < len(runes) && runes[j] == 'H' {
+				pos := strings.SplitN(string(runes[i+2:j]), ";", 2)
+				r, _ = strconv.Atoi(pos[0])
+				c, _ = strconv.Atoi(pos[1])
+			}
+			i = j
+			continue
+		}
+		if r >= 1 && r <= len(g) && c >= 1 && c <= len(g[r-1]) {
+			g[r-1][c-1] = runes[i]
+		}
+		c++
+	}
+}
+
+// row returns screen row r (1-indexed) without trailing blanks.
+func (g grid) row(r int) string {
+	return strings.TrimRight(string(g[r-1]), " ")
+}
+
+// testPanel is an 8×3 panel whose content starts at row 2, column 3.
+func testPanel(t *testing.T) (*splitScreen, *panel, grid) {
+	withRender(t, renderOptions{tabStop: 4})
+	return &splitScreen{termW: 12}, &panel{r0: 2, c0: 3, w: 8, h: 3}, newGrid(5, 12)
+}
+
+func writePanel(ss *splitScreen, p *panel, g grid, text string) {
+	var out strings.Builder
+	ss.writeInto(p, text, &out)
+	g.apply(out.String())
+}
+
+func TestPanelClipsOverflow(t *testing.T) {
+	ss, p, g := testPanel(t)
+	writePanel(ss, p, g, "abcdefghij")
+	if len(p.lines) != 1 || p.lines[0] != "abcdefg" || !p.clipped[0] {
+		t.Fatalf("lines = %q, clipped = %v; want the row cut before h", p.lines, p.clipped)
+	}
+	if got := g.row(2); got != "  abcdefg›" {
+		t.Errorf("row 2 = %q, want the clip marker in the last cell", got)
+	}
+	if got := g.row(3); got != "  hij" {
+		t.Errorf("row 3 = %q, want the carried h and the rest", got)
+	}
+	if p.cr != 1 || p.cc != 3 {
+		t.Errorf("cursor = %d,%d, want 1,3", p.cr, p.cc)
+	}
+}
+
+func TestPanelScrolls(t *testing.T) {
+	ss, p, g := testPanel(t)
+	writePanel(ss, p, g, "one\ntwo\nthree\nfour\n")
+	if want := []string{"one", "two", "three", "four"}; strings.Join(p.lines, ",") != strings.Join(want, ",") {
+		t.Fatalf("lines = %q, want %q", p.lines, want)
+	}
+	for r, want := range map[int]string{2: "  three", 3: "  four", 4: ""} {
+		if got := g.row(r); got != want {
+			t.Errorf("row %d = %q, want %q", r, got, want)
+		}
+	}
+	if p.cr != 2 || p.cc != 0 {
+		t.Errorf("cursor = %d,%d, want the bottom row, 2,0", p.cr, p.cc)
+	}
+}
+
+func TestPanelKeepsClipMarkerWhenScrolling(t *testing.T) {
+	ss, p, g := testPanel(t)
+	writePanel(ss, p, g, "0\n1\nabcdefghij")
+	if got := g.row(2); got != "  1" {
+		t.Errorf("row 2 = %q, want 1 after the clip scrolled", got)
+	}
+	if got := g.row(3); got != "  abcdefg›" {
+		t.Errorf("row 3 = %q, want the clipped row redrawn with its marker", got)
+	}
+	if got := g.row(4); got != "  hij" {
+		t.Errorf("row 4 = %q, want the carried h and the rest", got)
+	}
+}
+
+func TestPanelCarriageReturnAndTab(t *testing.T) {
+	ss, p, g := testPanel(t)
+	writePanel(ss, p, g, "ab\r\ncd\n")
+	if len(p.lines) != 2 || p.lines[0] != "ab" || p.lines[1] != "cd" {
+		t.Errorf("lines = %q, want \\r dropped", p.lines)
+	}
+	writePanel(ss, p, g, "a\tb")
+	if got := g.row(4); got != "  a   b" {
+		t.Errorf("row 4 = %q, want the tab padded to column 4", got)
+	}
+	if p.cc != 5 {
+		t.Errorf("cc = %d, want 5", p.cc)
+	}
+}
+
+// quietStdout sends what the screen prints to /dev/null for the test.
+func quietStdout(t *testing.T) {
+	t.Helper()
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = null
+	t.Cleanup(func() { os.Stdout = saved; null.Close() })
+}
+
+func TestPanelWriteJoinsSplitRune(t *testing.T) {
+	ss, p, _ := testPanel(t)
+	quietStdout(t)
+	word := "привет"
+	ss.write(p, word[:5]) // "пр" and the first byte of "и"
+	if p.partial != word[4:5] {
+		t.Errorf("partial = %q, want the held-back lead byte", p.partial)
+	}
+	ss.write(p, word[5:]+"\n")
+	if p.lines[0] != word || strings.ContainsRune(p.buf.String(), utf8.RuneError) {
+		t.Errorf("lines = %q, buf = %q; want %q with no replacement character", p.lines, p.buf.String(), word)
+	}
+}
+
+func TestSplitUTF8(t *testing.T) {
+	tests := []struct{ in, complete, tail string }{
+		{"abc", "abc", ""},
+		{"ab\xd0", "ab", "\xd0"},
+		{"€"[:2], "", "€"[:2]},
+		{"x🙂"[:4], "x", "🙂"[:3]},
+		{"é", "é", ""},
+	}
+	for _, tt := range tests {
+		complete, tail := splitUTF8(tt.in)
+		if complete != tt.complete || tail != tt.tail {
+			t.Errorf("splitUTF8(%q) = %q, %q; want %q, %q", tt.in, complete, tail, tt.complete, tt.tail)
+		}
+	}
+}
+
+// captureStdout returns what fn prints.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = saved }()
+	fn()
+	w.Close()
+	out, _ := io.ReadAll(r)
+	return string(out)
+}
+
+func TestDrawQuestionFitsNarrowTerminals(t *testing.T) {
+	for _, question := range []string{
+		strings.Repeat("a very long question that needs two lines ", 5),
+		strings.Repeat("这是一个需要两行的很长的问题", 5), // two cells a rune
+	} {
+		for _, w := range []int{0, 1, 3, 8, 10, 12, 20, 80} {
+			for _, english := range []bool{false, true} {
+				ss := &splitScreen{termW: w, questR: 1, question: question, english: english}
+				g := newGrid(2, 120)
+				g.apply(captureStdout(t, ss.drawQuestion))
+				for r := 1; r <= 2; r++ {
+					if n := stringWidth(g.row(r)); n > w {
+						t.Errorf("width %d: row %d is %d columns: %q", w, r, n, g.row(r))
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestJudgeRejectsUnfinishedPanels(t *testing.T) {
+	quietStdout(t)
+	expect, _ := parseExpected("42")
+	ss := &splitScreen{expect: expect}
+	for _, p := range []*panel{
+		{reply: "the answer is 42", err: errStopped},
+		{reply: "the answer is 42", stopped: true},
+	} {
+		ss.judge(p)
+		if p.correct || !strings.HasSuffix(p.title, " ✗") {
+			t.Errorf("panel (err %v, stopped %v) judged correct = %v, title %q", p.err, p.stopped, p.correct, p.title)
+		}
+	}
+	p := &panel{reply: "the answer is 42"}
+	ss.judge(p)
+	if !p.correct {
+		t.Error("a finished panel with the answer was judged wrong")
+	}
+}
+
+func TestLineupAzureEndpoint(t *testing.T) {
+	t.Setenv("AZURE_OPENAI_ENDPOINT", "https://res.openai.azure.com/")
+	t.Setenv("AZURE_OPENAI_API_KEY", "k")
+	models, err := lineupModels("azure:my-deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := models[0]
+	want := "https://res.openai.azure.com/openai/deployments/my-deploy/chat/completions?api-version=2024-10-21"
+	if got := mi.endpoint(); got != want {
+		t.Errorf("endpoint = %q, want %q", got, want)
+	}
+	req, _ := http.NewRequest("POST", want, nil)
+	mi.setAuth(req)
+	if got := req.Header.Get("api-key"); got != "k" {
+		t.Errorf("api-key = %q, want %q", got, "k")
+	}
+	if got := req.Header.Get("Authorization"); got != "" {
+		t.Errorf("Authorization = %q, want none", got)
+	}
+}
+
+func TestComparisonFailsOnlyWhenEveryPanelFailed(t *testing.T) {
+	ss := &splitScreen{panels: []*panel{{}, {}}}
+	ss.panels[0].err = &apiError{status: 500}
+	if err := ss.failure(); err != nil {
+		t.Errorf("one panel got through, failure() = %v", err)
+	}
+	ss.panels[1].err = errStopped
+	ss.failed = ss.panels[0]
+	var ae *apiError
+	if err := ss.failure(); !errors.As(err, &ae) {
+		t.Errorf("failure() = %v, want the first panel's API error", err)
+	}
+}
+
+func TestParsePanelTokens(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []int
+		ok   bool
+	}{
+		{"", nil, true},
+		{",,,2048", []int{0, 0, 0, 2048}, true},
+		{"512, 1024", []int{512, 1024}, true},
+		{"1,2,3,4,5,6", nil, false},
+		{"0", nil, false},
+		{"lots", nil, false},
+	} {
+		got, err := parsePanelTokens(tc.in)
+		if (err == nil) != tc.ok || !slices.Equal(got, tc.want) {
+			t.Errorf("parsePanelTokens(%q) = %v, %v", tc.in, got, err)
+		}
+	}
+}
+
+func TestPanelTitleFitsFrame(t *testing.T) {
+	for _, title := range []string{"anthropic:sonnet · 2/3 ✓", "模型比较标题很长"} {
+		p := &panel{w: 10, title: title}
+		if n := stringWidth(p.shownTitle()); n > p.w-2 {
+			t.Errorf("%q shows as %q, %d columns over a %d-column frame", title, p.shownTitle(), n, p.w)
+		}
+	}
+}
+
+func TestStatusAliveFollowsLanguage(t *testing.T) {
+	for _, tc := range []struct {
+		english bool
+		want    string
+	}{{false, "жив"}, {true, "alive"}} {
+		ss := &splitScreen{termW: 40, statusR: 1, english: tc.english, panels: []*panel{{alive: true}, {tokens: 12, exact: true}}}
+		var out strings.Builder
+		ss.drawTokens(&out)
+		g := newGrid(1, 40)
+		g.apply(out.String())
+		row := g.row(1)
+		if !strings.HasSuffix(row, "tok "+tc.want+" · 12") || stringWidth(row) != 40 {
+			t.Errorf("english=%v: status row %q, want it to end in %q, right-aligned", tc.english, row, tc.want)
+		}
+	}
+}
+
+func TestFailFastMarksOnlyTheFailedPanel(t *testing.T) {
+	withRender(t, renderOptions{})
+	quietStdout(t)
+	failed := &panel{title: "sonnet", w: 30, err: &apiError{status: 500}}
+	stopped := &panel{title: "haiku", w: 30, err: errStopped}
+	ss := &splitScreen{english: true, panels: []*panel{failed, stopped}}
+	ss.markOutcome(failed, false)
+	ss.markOutcome(stopped, true)
+
+	if !strings.HasSuffix(failed.title, markFailed) || !strings.HasSuffix(stopped.title, markCancelled) {
+		t.Errorf("titles %q and %q, want failed and cancelled markers", failed.title, stopped.title)
+	}
+	got := stripANSI(ss.outcomes())
+	if want := "Failed ⚠: 1. Cancelled ⊘: 2. "; got != want {
+		t.Errorf("outcomes = %q, want %q", got, want)
+	}
+	var out strings.Builder
+	drawTitle(failed, &out)
+	if !strings.Contains(out.String(), activeTheme.failed+markFailed) {
+		t.Errorf("failed marker not colored: %q", out.String())
+	}
+	if got := plainTitle(failed.title); got != "sonnet" {
+		t.Errorf("plainTitle = %q", got)
+	}
+}
+
+func TestTechniqueConfigs(t *testing.T) {
+	cfg := config{maxTokens: 1000}
+	pcs, err := techniqueConfigs(cfg)
+	if err != nil || pcs[3].maxTokens != 2000 || pcs[0].maxTokens != 0 {
+		t.Errorf("defaults = %+v, %v; want only the expert panel at twice --max-tokens", pcs, err)
+	}
+
+	cfg.panelTokens, cfg.panelModels, cfg.panelTemps = "500,,,3000", "haiku", ",,,,0.9"
+	pcs, err = techniqueConfigs(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pcs[0].maxTokens != 500 || pcs[3].maxTokens != 3000 || pcs[1].maxTokens != 0 {
+		t.Errorf("max tokens = %+v", pcs)
+	}
+	if model, _ := anthropicModel("haiku"); pcs[0].model != model || pcs[1].model != "" {
+		t.Errorf("models = %q, %q; want %q for the first panel only", pcs[0].model, pcs[1].model, model)
+	}
+	if pcs[4].temperature == nil || *pcs[4].temperature != 0.9 || pcs[0].temperature != nil {
+		t.Errorf("temperatures = %v, %v", pcs[0].temperature, pcs[4].temperature)
+	}
+
+	for _, bad := range []config{{panelModels: "gpt-4o"}, {panelTemps: "hot"}, {panelTemps: "1.5"}, {panelModels: "a,b,c,d,e,f"}} {
+		if _, err := techniqueConfigs(bad); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+}
+
+func TestResetPanelClearsLayoutState(t *testing.T) {
+	quietStdout(t)
+	withRender(t, renderOptions{compact: true})
+	ss := &splitScreen{}
+	p := &panel{w: 20, h: 5, r0: 2, c0: 2}
+	ss.setGutter(p, "│ ")
+	ss.write(p, "boxed\n\n\n")
+	ss.resetPanel(p)
+	if p.gutter != "" || p.squeeze != (blankSqueezer{}) {
+		t.Errorf("after reset: gutter %q, squeeze %+v", p.gutter, p.squeeze)
+	}
+	ss.write(p, "fresh")
+	if got := p.buf.String(); got != "fresh" {
+		t.Errorf("retried panel starts with %q, want %q", got, "fresh")
+	}
+}
@@ -3,14 +3,36 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/fs"
+	"maps"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type message struct {
@@ -18,16 +40,115 @@ type message struct {
 	Content string `json:"content"`
 }
 
+const defaultModel = "claude-sonnet-4-5-20250929"
+
 type config struct {
+	model        string
+	preset       string
 	maxTokens    int
 	temperature  float64
+	costWarn     float64 // ask before sending a request estimated above $N; 0 never asks
 	system       string
+	systemFile   string // path given via --system-file
+	systemText   string // contents of systemFile; takes precedence over system
 	stop         string
 	format       string
+	userLabel    string // prompt before the user's input
+	historyFile  string // saved prompt history; "" keeps it in memory only
+	historySize  int    // prompt history lines kept; 0 saves none
+	replyLabel   string // prompt before replies; "" derives it from the model
 	compare      string
+	samples      int    // answers the self-consistency panel samples
+	panelTokens  string // per-panel max tokens in the technique comparison
+	panelModels  string // per-panel models in the technique comparison
+	panelTemps   string // per-panel temperatures in the technique comparison
+	expected     string // known answer to check comparison panels against
 	tempCompare  string
 	modelCompare string
+	repeat       int    // runs per model in the model comparison
+	lineup       string // provider:model list replacing the default model lineup
+	saveCmp      string // write finished comparisons to this .cmp.json file
+	replay       string // .cmp.json file to reopen instead of chatting
+	batch        string // file of questions for a headless model comparison
+	metricsOut   string // CSV file the batch appends its metrics to
+	failFast     bool   // the first failed panel or batch request stops the rest
 	verbose      bool
+	contextLimit int    // approximate token budget for history; 0 = unlimited
+	summarizeOld bool   // summarize trimmed turns instead of dropping them
+	summary      string // summary of trimmed turns, sent with the system prompt
+	typingDelay  int    // ms between printed words in chat replies
+	bell         string // completion alert: beep, flash, notify or "" for none
+	flush        string // when streamed text is printed: "lines" or "words"
+	pager        bool   // collect each chat reply and show it through $PAGER
+	prettyJSON   bool   // reprint JSON replies indented and colored
+	noStream     bool   // ask for whole chat replies (stream: false)
+	strictStream bool   // report SSE events dropped as unparseable
+	suggest      bool   // offer numbered follow-up questions after replies
+	thinking     bool   // show reasoning models' thinking in the panels
+	last         bool   // ask the previous question again (~/.challenge_last.json)
+	spend        bool   // report the recorded spend and exit
+	countTokens  string // text to count tokens of, then exit
+	debugLog     string // JSONL file recording every request and SSE event
+	extraJSON    string // JSON object merged over each Messages request
+	jsonSchema   string // JSON Schema file chat replies are checked against
+	theme        string
+	noColor      bool
+	anthropicURL string // gateway or proxy in place of api.anthropic.com
+	apiVersion   string
+	betas        stringList
+	client       doer // nil uses http.DefaultClient
+	mock         bool // serve canned streams instead of calling any API
+	dryRun       bool // show each request instead of sending it
+	check        bool // verify the models exist before starting
+
+	ledger *spendLog // where priced requests are recorded; nil records none
+}
+
+// doer sends HTTP requests. It is satisfied by *http.Client and lets tests
+// and offline modes replace the network.
+type doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// labels are the chat prompts for the user's turns and the replies.
+func (cfg config) labels() (user, reply string) {
+	if cfg.replyLabel != "" {
+		return cfg.userLabel, cfg.replyLabel
+	}
+	model := strings.ToLower(cfg.model)
+	switch {
+	case strings.HasPrefix(model, "claude"):
+		return cfg.userLabel, "Claude"
+	case strings.HasPrefix(model, "gpt") || isReasoningModel(model):
+		return cfg.userLabel, "GPT"
+	case strings.HasPrefix(model, "gemini"):
+		return cfg.userLabel, "Gemini"
+	}
+	return cfg.userLabel, "Assistant"
+}
+
+// wantsJSON reports whether JSON replies get the pretty reprint: asked for
+// with --pretty-json, or implied by --json-schema or a --format that
+// mentions JSON.
+func (cfg config) wantsJSON() bool {
+	return cfg.prettyJSON || cfg.jsonSchema != "" || strings.Contains(strings.ToLower(cfg.format), "json")
+}
+
+func (cfg config) httpClient() doer {
+	if cfg.client != nil {
+		return cfg.client
+	}
+	return http.DefaultClient
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
 }
 
 type modelInfo struct {
@@ -35,370 +156,4528 @@ type modelInfo struct {
 	provider string
 	baseURL  string
 	apiKey   string
+	keyEnv   string // env var the key came from, named when authentication fails
 	model    string
 	costIn   float64 // cost per 1M input tokens
 	costOut  float64 // cost per 1M output tokens
-}
-
-// ─── Markdown rendering ───────────────────────────────────────────────────────
 
-var (
-	reCodeBlock  = regexp.MustCompile("(?s)```[a-z]*\n?(.*?)```")
-	reCodeInline = regexp.MustCompile("`([^`\n]+)`")
-	reBold       = regexp.MustCompile(`\*\*([^*\n]+)\*\*`)
-	reHeading    = regexp.MustCompile(`(?m)^#{1,3} (.+)$`)
-	reHRule      = regexp.MustCompile(`(?m)^[-*_]{3,}\s*$`)
-	reBullet     = regexp.MustCompile(`(?m)^(\s*)[*-] `)
-)
+	// Optional per-model request overrides; zero values use the shared config.
+	maxTokens   int
+	temperature *float64
 
-func renderMarkdown(s string) string {
-	s = reCodeBlock.ReplaceAllString(s, "\033[33m$1\033[0m")
-	s = reBold.ReplaceAllString(s, "\033[1m$1\033[0m")
-	s = reCodeInline.ReplaceAllString(s, "\033[33m$1\033[0m")
-	s = reHeading.ReplaceAllString(s, "\033[1m$1\033[0m")
-	s = reHRule.ReplaceAllString(s, strings.Repeat("─", 60))
-	s = reBullet.ReplaceAllString(s, "$1• ")
-	return s
+	// OpenAI-compatible endpoint details for Azure and gateways; zero values
+	// mean vanilla OpenAI.
+	path       string // request path, may include a query; {model} expands to the model
+	authHeader string // header that carries the key
+	authFormat string // value of that header, %s is the key
 }
 
-// ─── App ──────────────────────────────────────────────────────────────────────
-
-func main() {
-	cfg := parseArgs()
-
-	apiKey := loadEnv(".env", "ANTHROPIC_API_KEY")
-	if apiKey == "" {
-		fmt.Fprintln(os.Stderr, "ANTHROPIC_API_KEY not set in .env")
-		os.Exit(1)
+// endpoint is the chat completions URL of an OpenAI-compatible provider.
+func (mi modelInfo) endpoint() string {
+	path := mi.path
+	if path == "" {
+		path = "/v1/chat/completions"
 	}
-	openaiKey := loadEnv(".env", "OPENAI_API_KEY")
+	return mi.baseURL + strings.ReplaceAll(path, "{model}", url.PathEscape(mi.model))
+}
 
-	if cfg.compare != "" {
-		scanner := bufio.NewScanner(os.Stdin)
-		runComparison(apiKey, cfg, cfg.compare, scanner)
+// setAuth adds the provider's key to req, as a Bearer token unless the
+// provider says otherwise (Azure wants "api-key: <key>").
+func (mi modelInfo) setAuth(req *http.Request) {
+	if mi.apiKey == "" {
 		return
 	}
-
-	if cfg.tempCompare != "" {
-		scanner := bufio.NewScanner(os.Stdin)
-		runTempComparison(apiKey, cfg, cfg.tempCompare, scanner)
-		return
+	header, format := mi.authHeader, mi.authFormat
+	if header == "" {
+		header = "Authorization"
 	}
-
-	if cfg.modelCompare != "" {
-		scanner := bufio.NewScanner(os.Stdin)
-		runModelComparison(apiKey, openaiKey, cfg, cfg.modelCompare, scanner)
-		return
+	if format == "" {
+		format = "Bearer %s"
 	}
-
-	printBanner(cfg, openaiKey)
-	runChat(apiKey, openaiKey, cfg)
+	req.Header.Set(header, fmt.Sprintf(format, mi.apiKey))
 }
 
-func parseArgs() config {
-	cfg := config{}
-	flag.IntVar(&cfg.maxTokens, "max-tokens", 1024, "max response tokens")
-	flag.StringVar(&cfg.system, "system", "", "system prompt")
-	flag.StringVar(&cfg.stop, "stop", "", "stop sequence")
-	flag.StringVar(&cfg.format, "format", "", "response format instruction")
-	flag.Float64Var(&cfg.temperature, "temperature", -1, "sampling temperature (0.0–1.0, default: API default)")
-	flag.StringVar(&cfg.compare, "compare", "", "run 4-way comparison and exit")
-	flag.StringVar(&cfg.tempCompare, "tempcompare", "", "run 3-way temperature comparison and exit")
-	flag.StringVar(&cfg.modelCompare, "models", "", "run 3-way model comparison and exit")
-	flag.BoolVar(&cfg.verbose, "verbose", false, "print each request as curl before sending")
-	flag.Parse()
-	return cfg
-}
+// ─── Themes ───────────────────────────────────────────────────────────────────
 
-func printBanner(cfg config, openaiKey string) {
-	fmt.Println("=== Claude CLI Chat ===")
-	fmt.Printf("Model:      claude-sonnet-4-5-20250929\n")
-	fmt.Printf("Max tokens: %d\n", cfg.maxTokens)
-	if cfg.system != "" {
-		fmt.Printf("System:     %s\n", cfg.system)
-	}
-	if cfg.temperature >= 0 {
-		fmt.Printf("Temperature:%.1f\n", cfg.temperature)
-	}
-	if cfg.stop != "" {
-		fmt.Printf("Stop:       %q\n", cfg.stop)
-	}
-	if cfg.format != "" {
-		fmt.Printf("Format:     %s\n", cfg.format)
+// colorDepth is how many colors the terminal can show.
+type colorDepth int
+
+const (
+	colorNone colorDepth = iota // attributes such as bold only
+	color16
+	color256
+	colorTrue
+)
+
+// detectColor guesses the terminal's color depth from the environment.
+// NO_COLOR (https://no-color.org) turns color off.
+func detectColor() colorDepth {
+	if os.Getenv("NO_COLOR") != "" {
+		return colorNone
 	}
-	if cfg.verbose {
-		fmt.Printf("Verbose:    on (curl output to stderr)\n")
+	switch ct := strings.ToLower(os.Getenv("COLORTERM")); ct {
+	case "truecolor", "24bit":
+		return colorTrue
 	}
-	if openaiKey != "" {
-		fmt.Printf("OpenAI:     loaded\n")
+	if strings.Contains(os.Getenv("TERM"), "256color") {
+		return color256
 	}
-	fmt.Println()
-	fmt.Println("Type /help for commands, \"exit\" or \"quit\" to quit.")
-	fmt.Println()
+	return color16
 }
 
-func printHelp() {
-	fmt.Println("Commands:")
-	fmt.Println("  /help                — show this help")
-	fmt.Println("  /clear               — reset conversation history")
-	fmt.Println("  /system <text>       — update system prompt")
-	fmt.Println("  /compare <question>  — stream 4 reasoning approaches side-by-side")
-	fmt.Println("  /temp <question>     — compare temperature 0 / 0.7 / 1.0 side-by-side")
-	fmt.Println("  /models <question>   — compare weak/medium/strong models side-by-side")
-	fmt.Println("  exit / quit          — quit")
-	fmt.Println()
-	fmt.Println("Flags (set at startup):")
-	fmt.Println("  --max-tokens int    max response tokens (default 1024)")
-	fmt.Println("  --system string     system prompt")
-	fmt.Println("  --stop string       stop sequence")
-	fmt.Println("  --format string     response format instruction")
-	fmt.Println("  --temperature float  sampling temperature (0.0–1.0)")
-	fmt.Println("  --compare string    run 4-way comparison directly and exit")
-	fmt.Println("  --tempcompare str   run 3-way temperature comparison and exit")
-	fmt.Println("  --models string     run 3-way model comparison and exit")
-	fmt.Println("  --verbose           print each request as curl before sending")
-	fmt.Println()
+// shade is one themed style, given for every color depth. A zero ansi16
+// means no color, leaving only the bold attribute (if any).
+type shade struct {
+	ansi16  int    // 30–37 or 90–97
+	ansi256 int    // xterm 256-color index
+	rgb     uint32 // 0xRRGGBB
+	bold    bool
 }
 
-func buildSystemPrompt(cfg config) string {
-	parts := []string{}
-	if cfg.system != "" {
-		parts = append(parts, cfg.system)
+// sgr returns the escape sequence selecting s at depth d, or "" for plain text.
+func (s shade) sgr(d colorDepth) string {
+	var codes []string
+	if s.bold {
+		codes = append(codes, "1")
 	}
-	if cfg.format != "" {
-		parts = append(parts, "Always respond in this format: "+cfg.format)
+	if s.ansi16 != 0 {
+		switch d {
+		case colorTrue:
+			codes = append(codes, fmt.Sprintf("38;2;%d;%d;%d", s.rgb>>16, s.rgb>>8&0xff, s.rgb&0xff))
+		case color256:
+			codes = append(codes, fmt.Sprintf("38;5;%d", s.ansi256))
+		case color16:
+			codes = append(codes, fmt.Sprint(s.ansi16))
+		}
 	}
-	if cfg.stop != "" {
-		parts = append(parts, "Always end your response with: "+cfg.stop)
+	if len(codes) == 0 {
+		return ""
 	}
-	return strings.Join(parts, "\n")
+	return "\033[" + strings.Join(codes, ";") + "m"
 }
 
-func runChat(apiKey, openaiKey string, cfg config) {
-	scanner := bufio.NewScanner(os.Stdin)
-	var history []message
-
-	for {
-		fmt.Print("You: ")
-		if !scanner.Scan() {
-			break
-		}
-		input := strings.TrimSpace(scanner.Text())
-		if input == "" {
-			continue
-		}
+// palette is a named color scheme for panel titles and rendered markdown.
+type palette struct {
+	panels [5]shade // panel title colors, in panel order
+	code   shade
+	strong shade // bold text and headings
+	done   shade // checked task-list boxes
+	muted  shade // code block language labels
+	failed shade // the failed-panel marker
+}
 
-		switch {
-		case input == "exit" || input == "quit":
-			fmt.Println("Goodbye!")
-			return
-		case input == "/help":
-			printHelp()
-			continue
-		case input == "/clear":
-			history = nil
-			fmt.Println("History cleared.")
-			fmt.Println()
-			continue
-		case strings.HasPrefix(input, "/system "):
-			cfg.system = strings.TrimPrefix(input, "/system ")
-			fmt.Printf("System prompt updated: %s\n\n", cfg.system)
-			continue
-		case strings.HasPrefix(input, "/compare "):
-			question := strings.TrimPrefix(input, "/compare ")
-			runComparison(apiKey, cfg, question, scanner)
-			printBanner(cfg, openaiKey)
-			continue
-		case strings.HasPrefix(input, "/temp "):
-			question := strings.TrimPrefix(input, "/temp ")
-			runTempComparison(apiKey, cfg, question, scanner)
-			printBanner(cfg, openaiKey)
-			continue
-		case strings.HasPrefix(input, "/models "):
-			question := strings.TrimPrefix(input, "/models ")
-			runModelComparison(apiKey, openaiKey, cfg, question, scanner)
-			printBanner(cfg, openaiKey)
-			continue
-		}
+var bold = shade{bold: true}
 
-		history = append(history, message{Role: "user", Content: input})
+var themes = map[string]palette{
+	"default": {
+		panels: [5]shade{{94, 75, 0x5fafff, false}, {92, 114, 0x87d787, false}, {93, 221, 0xffd75f, false}, {95, 177, 0xd787ff, false}, {96, 80, 0x5fd7d7, false}},
+		code:   shade{33, 179, 0xd7af5f, false},
+		strong: bold,
+		done:   shade{92, 114, 0x87d787, false},
+		muted:  shade{90, 244, 0x808080, false},
+		failed: shade{91, 203, 0xff5f5f, false},
+	},
+	"high-contrast": {
+		panels: [5]shade{{94, 33, 0x0087ff, true}, {92, 46, 0x00ff00, true}, {93, 226, 0xffff00, true}, {95, 201, 0xff00ff, true}, {96, 51, 0x00ffff, true}},
+		code:   shade{93, 227, 0xffff5f, true},
+		strong: shade{97, 231, 0xffffff, true},
+		done:   shade{92, 46, 0x00ff00, true},
+		muted:  shade{37, 250, 0xbcbcbc, false},
+		failed: shade{91, 196, 0xff0000, true},
+	},
+	// Okabe–Ito colors, distinguishable with red-green deficiency.
+	"colorblind": {
+		panels: [5]shade{{34, 25, 0x0072b2, false}, {33, 214, 0xe69f00, false}, {96, 74, 0x56b4e9, false}, {95, 175, 0xcc79a7, false}, {31, 166, 0xd55e00, false}},
+		code:   shade{93, 227, 0xf0e442, false},
+		strong: bold,
+		done:   shade{32, 36, 0x009e73, false},
+		muted:  shade{90, 244, 0x808080, false},
+		failed: shade{31, 166, 0xd55e00, true},
+	},
+	"monochrome": {
+		panels: [5]shade{bold, bold, bold, bold, bold},
+		strong: bold,
+		failed: bold,
+	},
+}
 
-		fmt.Print("\nClaude: ")
-		reply, err := streamChat(apiKey, cfg, history)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "\nError:", err)
-			history = history[:len(history)-1]
-			continue
-		}
-		fmt.Println("\n")
+// theme is a palette resolved to escape sequences for the current terminal.
+// An empty style means plain text.
+type theme struct {
+	panels [5]string
+	code   string
+	strong string
+	done   string
+	muted  string
+	failed string
+}
 
-		history = append(history, message{Role: "assistant", Content: reply})
+func (p palette) resolve(d colorDepth) theme {
+	t := theme{code: p.code.sgr(d), strong: p.strong.sgr(d), done: p.done.sgr(d), muted: p.muted.sgr(d), failed: p.failed.sgr(d)}
+	for i, s := range p.panels {
+		t.panels[i] = s.sgr(d)
 	}
+	return t
 }
 
-// ─── API ──────────────────────────────────────────────────────────────────────
+var activeTheme = themes["default"].resolve(detectColor())
 
-func buildRequest(cfg config, msgs []message) map[string]any {
-	req := map[string]any{
-		"model":      "claude-sonnet-4-5-20250929",
-		"max_tokens": cfg.maxTokens,
-		"messages":   msgs,
-		"stream":     true,
+// themeNames lists the available themes for help and error messages.
+func themeNames() string {
+	names := make([]string, 0, len(themes))
+	for name := range themes {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
 
-	if cfg.temperature >= 0 {
-		req["temperature"] = cfg.temperature
-	}
-	if sp := buildSystemPrompt(cfg); sp != "" {
-		req["system"] = sp
-	}
-	if cfg.stop != "" {
-		req["stop_sequences"] = []string{cfg.stop}
+// styled returns a regexp replacement template wrapping group in style.
+func styled(style, group string) string {
+	if style == "" {
+		return group
 	}
+	return style + group + "\033[0m"
+}
 
-	return req
+// ─── Markdown rendering ───────────────────────────────────────────────────────
+
+var (
+	reCodeBlock  = regexp.MustCompile("(?s)```([\\w+#.-]*)\n?(.*?)```") // 1: language, 2: code
+	reBold       = regexp.MustCompile(`\*\*([^*\n]+)\*\*`)
+	reHeading    = regexp.MustCompile(`(?m)^#{1,3} (.+)$`)
+	reHRule      = regexp.MustCompile(`(?m)^[-*_]{3,}\s*$`)
+	reTask       = regexp.MustCompile(`(?m)^([ \t]*)[*-] \[([ xX])\] `)
+	reBullet     = regexp.MustCompile(`(?m)^([ \t]*)[*-] `)
+	reAnyCode    = regexp.MustCompile("(?s)```.*?```|`[^`\n]+`")
+	reCodeSlot   = regexp.MustCompile("\x00[0-9]+\x00") // a shieldCode placeholder
+	reLink       = regexp.MustCompile(`\[([^\]\n]+)\]\((https?://[^)\s]+)\)`)
+	reListMarker = regexp.MustCompile(`^\s*(?:\d+[.)]|[-*•])\s+`)
+	reVarRef     = regexp.MustCompile(`\{(\w+)\}`)
+	reVarName    = regexp.MustCompile(`^\w+$`)
+)
+
+// renderOptions are the optional, best-effort markdown transforms.
+type renderOptions struct {
+	math     bool // LaTeX math to Unicode
+	linkRefs bool // [text](url) to text[n] plus footnotes
+	compact  bool // at most one blank line in a row outside code
+	raw      bool // no rendering at all: replies print as raw markdown
+	tabStop  int  // tabs expand to the next multiple of this column
 }
 
-func buildOpenAIRequest(model string, cfg config, msgs []message) map[string]any {
-	openaiMsgs := make([]map[string]string, 0, len(msgs)+1)
-	if sp := buildSystemPrompt(cfg); sp != "" {
-		openaiMsgs = append(openaiMsgs, map[string]string{"role": "system", "content": sp})
-	}
-	for _, m := range msgs {
-		openaiMsgs = append(openaiMsgs, map[string]string{"role": m.Role, "content": m.Content})
-	}
+var renderOpts renderOptions
 
-	req := map[string]any{
-		"model":          model,
-		"max_tokens":     cfg.maxTokens,
-		"messages":       openaiMsgs,
-		"stream":         true,
-		"stream_options": map[string]any{"include_usage": true},
+// renderMarkdown renders whole lines: the line rules (headings, rules and
+// lists) on the text with its code shielded, then renderInline. Tabs are
+// expanded first so "-\titem" is a bullet too.
+func renderMarkdown(s string, refs *linkRefs) string {
+	if renderOpts.raw {
+		return s
 	}
+	s = expandTabs(s, 0, renderOpts.tabStop)
+	s, code := shieldCode(s)
+	s = reHeading.ReplaceAllString(s, styled(activeTheme.strong, "$1"))
+	s = reHRule.ReplaceAllString(s, strings.Repeat("─", 60))
+	s = reTask.ReplaceAllStringFunc(s, func(m string) string {
+		g := reTask.FindStringSubmatch(m)
+		if g[2] == " " {
+			return expandIndent(g[1]) + "☐ "
+		}
+		return expandIndent(g[1]) + styled(activeTheme.done, "☑") + " "
+	})
+	s = reBullet.ReplaceAllStringFunc(s, func(m string) string {
+		indent := expandIndent(reBullet.FindStringSubmatch(m)[1])
+		return indent + bulletGlyphs[len(indent)/2%len(bulletGlyphs)] + " "
+	})
+	return renderInline(unshieldCode(s, code), 0, refs)
+}
 
-	if cfg.temperature >= 0 {
-		req["temperature"] = cfg.temperature
+// shieldCode swaps fenced blocks and code spans for numbered placeholders,
+// so the other rules never see their contents (no bold or bullets inside
+// code); restoreCode puts them back rendered.
+func shieldCode(s string) (string, []string) {
+	var code []string
+	s = reAnyCode.ReplaceAllStringFunc(s, func(m string) string {
+		code = append(code, m)
+		return fmt.Sprintf("\x00%d\x00", len(code)-1)
+	})
+	return s, code
+}
+
+// unshieldCode puts the code back as it was.
+func unshieldCode(s string, code []string) string {
+	return reCodeSlot.ReplaceAllStringFunc(s, func(m string) string {
+		n, _ := strconv.Atoi(m[1 : len(m)-1])
+		return code[n]
+	})
+}
+
+func restoreCode(s string, code []string) string {
+	return reCodeSlot.ReplaceAllStringFunc(s, func(m string) string {
+		n, _ := strconv.Atoi(m[1 : len(m)-1])
+		if g := reCodeBlock.FindStringSubmatch(code[n]); g != nil {
+			return renderCodeBlock(g[1], g[2])
+		}
+		return styled(activeTheme.code, code[n][1:len(code[n])-1])
+	})
+}
+
+// renderInline applies the inline transforms — tabs, math, link refs, bold
+// and code — to s, which starts at column col of its line. Text that does
+// not start a line gets only these, since the line rules would misfire.
+// Links are numbered into refs; a nil refs leaves them as they are.
+func renderInline(s string, col int, refs *linkRefs) string {
+	if renderOpts.raw {
+		return s
 	}
-	if cfg.stop != "" {
-		req["stop"] = []string{cfg.stop}
+	s = expandTabs(s, col, renderOpts.tabStop)
+	if renderOpts.math {
+		s = outsideCode(s, renderMath)
 	}
-
-	return req
+	if renderOpts.linkRefs && refs != nil {
+		s = outsideCode(s, refs.collect)
+	}
+	s, code := shieldCode(s)
+	s = reBold.ReplaceAllString(s, styled(activeTheme.strong, "$1"))
+	return restoreCode(s, code)
 }
 
-func maskKey(key string) string {
-	if len(key) <= 8 {
-		return "****"
+// bulletGlyphs cycle with list depth; each 2 columns of indent is a level.
+var bulletGlyphs = []string{"•", "◦", "▪"}
+
+// expandIndent turns leading whitespace into spaces, with tab stops every
+// 4 columns, so mixed tab/space indentation nests consistently.
+func expandIndent(ws string) string {
+	col := 0
+	for _, r := range ws {
+		if r == '\t' {
+			col += 4 - col%4
+		} else {
+			col++
+		}
 	}
-	return key[:8] + "****"
+	return strings.Repeat(" ", col)
 }
 
-func formatCurl(apiKey string, body []byte) string {
-	var pretty bytes.Buffer
-	json.Indent(&pretty, body, "  ", "  ")
+// outsideCode applies fn to the parts of s outside fenced and inline code.
+func outsideCode(s string, fn func(string) string) string {
 	var b strings.Builder
-	fmt.Fprintf(&b, "curl -X POST .../v1/messages \\\n")
-	fmt.Fprintf(&b, "  -H \"x-api-key: %s\" \\\n", maskKey(apiKey))
-	fmt.Fprintf(&b, "  -d '%s'\n", pretty.String())
+	last := 0
+	for _, loc := range reAnyCode.FindAllStringIndex(s, -1) {
+		b.WriteString(fn(s[last:loc[0]]))
+		b.WriteString(s[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(fn(s[last:]))
 	return b.String()
 }
 
-func printCurl(apiKey string, body []byte) {
-	fmt.Fprintf(os.Stderr, "\n\033[2m── curl ────────────────────────────────────────────────────\033[0m\n")
-	fmt.Fprintf(os.Stderr, "\033[2m%s\033[0m", formatCurl(apiKey, body))
-	fmt.Fprintf(os.Stderr, "\033[2m────────────────────────────────────────────────────────────\033[0m\n\n")
+// linkRefs numbers the URLs that --link-refs takes out of one reply.
+type linkRefs struct {
+	urls []string
 }
 
-func streamChat(apiKey string, cfg config, msgs []message) (string, error) {
-	body, _ := json.Marshal(buildRequest(cfg, msgs))
+// collect turns [text](url) into text[n], reusing n for repeated URLs.
+func (r *linkRefs) collect(s string) string {
+	return reLink.ReplaceAllStringFunc(s, func(m string) string {
+		g := reLink.FindStringSubmatch(m)
+		n := slices.Index(r.urls, g[2]) + 1
+		if n == 0 {
+			r.urls = append(r.urls, g[2])
+			n = len(r.urls)
+		}
+		return fmt.Sprintf("%s[%d]", g[1], n)
+	})
+}
 
-	if cfg.verbose {
-		printCurl(apiKey, body)
+// notes formats the collected links as footnote lines.
+func (r *linkRefs) notes() string {
+	notes := make([]string, len(r.urls))
+	for i, u := range r.urls {
+		notes[i] = fmt.Sprintf("\033[2m[%d] %s\033[0m", i+1, u)
 	}
+	return strings.Join(notes, "\n")
+}
 
-	req, _ := http.NewRequest("POST", "https://api.anthropic.com/v1/messages", bytes.NewReader(body))
-	req.Header.Set("x-api-key", apiKey)
-	req.Header.Set("anthropic-version", "2023-06-01")
-	req.Header.Set("content-type", "application/json")
+// linkNotes is the footnotes of a reply rendered with --link-refs, numbered
+// as rendering numbered them; "" when the option is off.
+func linkNotes(reply string) string {
+	if !renderOpts.linkRefs || renderOpts.raw {
+		return ""
+	}
+	var refs linkRefs
+	outsideCode(reply, refs.collect)
+	return refs.notes()
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
+// printLinkNotes prints the footnotes of a streamed reply.
+func printLinkNotes(reply string) {
+	if notes := linkNotes(reply); notes != "" {
+		fmt.Print(notes + "\n\n")
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode != 200 {
-		errBody, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("API error (%d): %s", resp.StatusCode, errBody)
+// renderCodeBlock styles a fenced block, labelling it with its language.
+func renderCodeBlock(lang, code string) string {
+	var b strings.Builder
+	if lang != "" {
+		b.WriteString(styled(activeTheme.muted, lang) + "\n")
+	}
+	if activeTheme.code == "" {
+		b.WriteString(code)
+	} else {
+		b.WriteString(activeTheme.code + code + "\033[0m")
 	}
+	return b.String()
+}
+
+// ─── Math ─────────────────────────────────────────────────────────────────────
+
+var (
+	// $$…$$, \[…\], \(…\) and $…$; a single $ must hug its content, as in
+	// pandoc, so prices like "$5 and $10" are left alone.
+	reMath     = regexp.MustCompile(`(?s:\$\$(.+?)\$\$)|(?s:\\\[(.+?)\\\])|\\\((.+?)\\\)|\$([^\s$](?:[^$\n]*?[^\s$])?)\$`)
+	reTeXText  = regexp.MustCompile(`\\(?:text|mathrm|mathbf|mathit|operatorname)\{([^{}]*)\}`)
+	reTeXFrac  = regexp.MustCompile(`\\[dt]?frac\{([^{}]*)\}\{([^{}]*)\}`)
+	reTeXSqrt  = regexp.MustCompile(`\\sqrt\{([^{}]*)\}`)
+	reTeXCmd   = regexp.MustCompile(`\\([A-Za-z]+)`)
+	reTeXSuper = regexp.MustCompile(`\^(\{[^{}]*\}|.)`)
+	reTeXSub   = regexp.MustCompile(`_(\{[^{}]*\}|.)`)
+)
 
-	return readStream(resp.Body)
+var texSymbols = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ε", "varepsilon": "ε",
+	"zeta": "ζ", "eta": "η", "theta": "θ", "iota": "ι", "kappa": "κ", "lambda": "λ", "mu": "μ",
+	"nu": "ν", "xi": "ξ", "pi": "π", "rho": "ρ", "sigma": "σ", "tau": "τ", "upsilon": "υ",
+	"phi": "φ", "varphi": "φ", "chi": "χ", "psi": "ψ", "omega": "ω",
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ", "Pi": "Π",
+	"Sigma": "Σ", "Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+	"times": "×", "cdot": "·", "div": "÷", "pm": "±", "mp": "∓",
+	"leq": "≤", "le": "≤", "geq": "≥", "ge": "≥", "neq": "≠", "ne": "≠", "approx": "≈",
+	"equiv": "≡", "sim": "∼", "propto": "∝", "infty": "∞", "partial": "∂", "nabla": "∇",
+	"sum": "∑", "prod": "∏", "int": "∫", "in": "∈", "notin": "∉", "subset": "⊂",
+	"subseteq": "⊆", "cup": "∪", "cap": "∩", "emptyset": "∅", "forall": "∀", "exists": "∃",
+	"neg": "¬", "land": "∧", "lor": "∨", "to": "→", "rightarrow": "→", "leftarrow": "←",
+	"Rightarrow": "⇒", "Leftarrow": "⇐", "iff": "⇔", "ldots": "…", "cdots": "⋯", "circ": "∘",
+	"left": "", "right": "", "displaystyle": "",
 }
 
-// readStream prints tokens as they arrive, rendering markdown line-by-line.
-func readStream(r io.Reader) (string, error) {
-	var full, pending strings.Builder
-	scanner := bufio.NewScanner(r)
+// superRunes and subRunes map characters to their Unicode script forms.
+var (
+	superRunes = map[rune]rune{}
+	subRunes   = map[rune]rune{}
+)
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "[DONE]" {
-			break
-		}
+func init() {
+	for i, r := range []rune("⁰¹²³⁴⁵⁶⁷⁸⁹") {
+		superRunes['0'+rune(i)] = r
+	}
+	for i, r := range []rune("₀₁₂₃₄₅₆₇₈₉") {
+		subRunes['0'+rune(i)] = r
+	}
+	for _, p := range []string{"+⁺", "-⁻", "=⁼", "(⁽", ")⁾", "nⁿ", "iⁱ", "aᵃ", "bᵇ", "cᶜ", "dᵈ", "eᵉ",
+		"fᶠ", "gᵍ", "hʰ", "jʲ", "kᵏ", "lˡ", "mᵐ", "oᵒ", "pᵖ", "rʳ", "sˢ", "tᵗ", "uᵘ", "vᵛ",
+		"wʷ", "xˣ", "yʸ", "zᶻ", "Tᵀ"} {
+		r := []rune(p)
+		superRunes[r[0]] = r[1]
+	}
+	for _, p := range []string{"+₊", "-₋", "=₌", "(₍", ")₎", "aₐ", "eₑ", "hₕ", "iᵢ", "jⱼ", "kₖ",
+		"lₗ", "mₘ", "nₙ", "oₒ", "pₚ", "rᵣ", "sₛ", "tₜ", "uᵤ", "vᵥ", "xₓ"} {
+		r := []rune(p)
+		subRunes[r[0]] = r[1]
+	}
+}
 
-		var event struct {
-			Type  string `json:"type"`
-			Delta struct {
-				Type string `json:"type"`
-				Text string `json:"text"`
-			} `json:"delta"`
-		}
-		if err := json.Unmarshal([]byte(data), &event); err != nil {
-			continue
+// renderMath replaces delimited LaTeX math in s with a Unicode approximation.
+func renderMath(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range reMath.FindAllStringSubmatchIndex(s, -1) {
+		end := m[1]
+		if m[8] >= 0 && end < len(s) && s[end] >= '0' && s[end] <= '9' {
+			continue // "$5 … $10": a closing $ is never followed by a digit
 		}
-		if event.Type == "content_block_delta" && event.Delta.Type == "text_delta" {
-			text := event.Delta.Text
-			full.WriteString(text)
-			pending.WriteString(text)
-
-			// Render complete lines as they arrive.
-			buf := pending.String()
-			if i := strings.LastIndex(buf, "\n"); i >= 0 {
-				fmt.Print(renderMarkdown(buf[:i+1]))
-				pending.Reset()
-				pending.WriteString(buf[i+1:])
+		b.WriteString(s[last:m[0]])
+		for g := 2; g < len(m); g += 2 {
+			if m[g] >= 0 {
+				b.WriteString(texToUnicode(s[m[g]:m[g+1]]))
+				break
 			}
 		}
+		last = end
 	}
+	b.WriteString(s[last:])
+	return b.String()
+}
 
-	if pending.Len() > 0 {
-		fmt.Print(renderMarkdown(pending.String()))
+// texToUnicode converts common LaTeX constructs; anything it doesn't know
+// is kept as written.
+func texToUnicode(tex string) string {
+	tex = reTeXText.ReplaceAllString(tex, "$1")
+	for reTeXFrac.MatchString(tex) {
+		tex = reTeXFrac.ReplaceAllStringFunc(tex, func(m string) string {
+			g := reTeXFrac.FindStringSubmatch(m)
+			return texGroup(g[1]) + "/" + texGroup(g[2])
+		})
 	}
+	tex = reTeXSqrt.ReplaceAllStringFunc(tex, func(m string) string {
+		return "√" + texGroup(reTeXSqrt.FindStringSubmatch(m)[1])
+	})
+	tex = reTeXCmd.ReplaceAllStringFunc(tex, func(m string) string {
+		if sym, ok := texSymbols[m[1:]]; ok {
+			return sym
+		}
+		return m
+	})
+	tex = strings.ReplaceAll(tex, `\,`, " ")
+	tex = reTeXSuper.ReplaceAllStringFunc(tex, func(m string) string { return texScript(m, "^", superRunes) })
+	tex = reTeXSub.ReplaceAllStringFunc(tex, func(m string) string { return texScript(m, "_", subRunes) })
+	return strings.NewReplacer("{", "", "}", "").Replace(strings.TrimSpace(tex))
+}
 
-	if err := scanner.Err(); err != nil {
-		return full.String(), err
+// texGroup parenthesizes a fraction or root operand longer than one symbol.
+func texGroup(s string) string {
+	s = strings.TrimSpace(s)
+	if utf8.RuneCountInString(s) <= 1 || strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) < 0 {
+		return s
 	}
-	return full.String(), nil
+	return "(" + s + ")"
 }
 
-// ─── Env ──────────────────────────────────────────────────────────────────────
+// texScript maps ^x / _{…} to Unicode super- or subscripts, falling back to
+// op(…) when some character has no such form.
+func texScript(m, op string, table map[rune]rune) string {
+	arg := strings.TrimSuffix(strings.TrimPrefix(m[1:], "{"), "}")
+	var b strings.Builder
+	for _, r := range arg {
+		mapped, ok := table[r]
+		if !ok {
+			if utf8.RuneCountInString(arg) == 1 {
+				return op + arg
+			}
+			return op + "(" + arg + ")"
+		}
+		b.WriteRune(mapped)
+	}
+	return b.String()
+}
+
+// ─── JSON ─────────────────────────────────────────────────────────────────────
+
+// jsonReply returns the JSON object or array a reply consists of, on its own
+// or as the only content of a code fence; ok is false for anything else.
+func jsonReply(text string) (string, bool) {
+	text = strings.TrimSpace(text)
+	if m := reCodeBlock.FindStringSubmatchIndex(text); m != nil && m[0] == 0 && m[1] == len(text) {
+		text = strings.TrimSpace(text[m[4]:m[5]])
+	}
+	if !strings.HasPrefix(text, "{") && !strings.HasPrefix(text, "[") || !json.Valid([]byte(text)) {
+		return "", false
+	}
+	return text, true
+}
+
+// prettyJSON indents and colors a reply that is JSON; ok is false otherwise.
+func prettyJSON(text string) (string, bool) {
+	text, ok := jsonReply(text)
+	if !ok {
+		return "", false
+	}
+	var b bytes.Buffer
+	if err := json.Indent(&b, []byte(text), "", "  "); err != nil {
+		return "", false
+	}
+	return colorJSON(b.String()), true
+}
+
+// colorJSON styles the tokens of valid JSON: keys, strings, numbers and
+// true/false/null each take one of the theme's panel colors.
+func colorJSON(s string) string {
+	keys, strs, nums, lits := activeTheme.panels[0], activeTheme.panels[1], activeTheme.panels[2], activeTheme.panels[3]
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"':
+			j := i + 1
+			for s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j++
+			style := strs
+			if rest := strings.TrimLeft(s[j:], " \n"); strings.HasPrefix(rest, ":") {
+				style = keys
+			}
+			b.WriteString(styled(style, s[i:j]))
+			i = j
+		case c == '-' || c >= '0' && c <= '9':
+			j := i + strings.IndexFunc(s[i:], func(r rune) bool { return !strings.ContainsRune("-+.eE0123456789", r) })
+			b.WriteString(styled(nums, s[i:j]))
+			i = j
+		case c == 't' || c == 'f' || c == 'n':
+			j := i + strings.IndexFunc(s[i:], func(r rune) bool { return r < 'a' || r > 'z' })
+			b.WriteString(styled(lits, s[i:j]))
+			i = j
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// loadSchema reads a JSON Schema file; the schema must be a JSON object.
+func loadSchema(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("--json-schema: %w", err)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("--json-schema %s: %w", path, err)
+	}
+	if err := checkPatterns(schema, "$"); err != nil {
+		return nil, fmt.Errorf("--json-schema %s: %w", path, err)
+	}
+	return schema, nil
+}
+
+// checkPatterns compiles every pattern in the parts of schema that
+// schemaErrors walks, so a bad one is reported up front rather than letting
+// any string through.
+func checkPatterns(schema map[string]any, path string) error {
+	if p, ok := schema["pattern"].(string); ok {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("%s: bad pattern: %w", path, err)
+		}
+	}
+	props, _ := schema["properties"].(map[string]any)
+	for _, k := range slices.Sorted(maps.Keys(props)) {
+		if sub, ok := props[k].(map[string]any); ok {
+			if err := checkPatterns(sub, path+"."+k); err != nil {
+				return err
+			}
+		}
+	}
+	if extra, ok := schema["additionalProperties"].(map[string]any); ok {
+		if err := checkPatterns(extra, path+".*"); err != nil {
+			return err
+		}
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		if err := checkPatterns(items, path+"[]"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replySchemaErrors checks a reply against schema, if there is one. A reply
+// that isn't JSON is one error.
+func replySchemaErrors(reply string, schema map[string]any) []string {
+	if schema == nil {
+		return nil
+	}
+	text, ok := jsonReply(reply)
+	if !ok {
+		return []string{"the reply is not a JSON object or array"}
+	}
+	var v any
+	json.Unmarshal([]byte(text), &v) // valid, checked by jsonReply
+	return schemaErrors(v, schema, "$")
+}
+
+// schemaErrors validates v against the subset of JSON Schema that structured
+// output relies on: type, enum, const, properties, required,
+// additionalProperties, items, pattern and the length, size and range
+// bounds. Other keywords are ignored. Each error names its JSONPath.
+func schemaErrors(v any, schema map[string]any, path string) []string {
+	var errs []string
+	fail := func(format string, args ...any) {
+		errs = append(errs, path+": "+fmt.Sprintf(format, args...))
+	}
+	if t, ok := schema["type"]; ok && !typeMatches(v, t) {
+		fail("expected %s, got %s", typeList(t), jsonType(v))
+		return errs
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.ContainsFunc(enum, func(e any) bool { return reflect.DeepEqual(e, v) }) {
+		fail("%s is not one of %s", compactJSON(v), compactJSON(enum))
+	}
+	if c, ok := schema["const"]; ok && !reflect.DeepEqual(c, v) {
+		fail("expected %s, got %s", compactJSON(c), compactJSON(v))
+	}
+	bound := func(key string) (float64, bool) {
+		n, ok := schema[key].(float64)
+		return n, ok
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		props, _ := schema["properties"].(map[string]any)
+		if req, ok := schema["required"].([]any); ok {
+			for _, k := range req {
+				if name, ok := k.(string); ok {
+					if _, ok := v[name]; !ok {
+						fail("missing required property %q", name)
+					}
+				}
+			}
+		}
+		keys := slices.Sorted(maps.Keys(v))
+		for _, k := range keys {
+			if sub, ok := props[k].(map[string]any); ok {
+				errs = append(errs, schemaErrors(v[k], sub, path+"."+k)...)
+				continue
+			}
+			switch extra := schema["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					fail("unexpected property %q", k)
+				}
+			case map[string]any:
+				errs = append(errs, schemaErrors(v[k], extra, path+"."+k)...)
+			}
+		}
+	case []any:
+		if n, ok := bound("minItems"); ok && float64(len(v)) < n {
+			fail("expected at least %g items, got %d", n, len(v))
+		}
+		if n, ok := bound("maxItems"); ok && float64(len(v)) > n {
+			fail("expected at most %g items, got %d", n, len(v))
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				errs = append(errs, schemaErrors(item, items, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if lo, ok := bound("minLength"); ok && float64(n) < lo {
+			fail("expected at least %g characters, got %d", lo, n)
+		}
+		if hi, ok := bound("maxLength"); ok && float64(n) > hi {
+			fail("expected at most %g characters, got %d", hi, n)
+		}
+		if p, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(p); err != nil {
+				fail("pattern %s does not compile", p) // checked by loadSchema
+			} else if !re.MatchString(v) {
+				fail("%q does not match pattern %s", v, p)
+			}
+		}
+	case float64:
+		if lo, ok := bound("minimum"); ok && v < lo {
+			fail("%g is below the minimum %g", v, lo)
+		}
+		if hi, ok := bound("maximum"); ok && v > hi {
+			fail("%g is above the maximum %g", v, hi)
+		}
+	}
+	return errs
+}
+
+// jsonType names the JSON type of a decoded value.
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	}
+	return "object"
+}
+
+// typeMatches reports whether v has the schema type t, a name or a list of
+// names; integers are numbers too.
+func typeMatches(v any, t any) bool {
+	names, ok := t.([]any)
+	if !ok {
+		names = []any{t}
+	}
+	got := jsonType(v)
+	for _, n := range names {
+		if n == got || n == "number" && got == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func typeList(t any) string {
+	if names, ok := t.([]any); ok {
+		parts := make([]string, len(names))
+		for i, n := range names {
+			parts[i] = fmt.Sprint(n)
+		}
+		return strings.Join(parts, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func compactJSON(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// repairPrompt is the follow-up asking the model to fix a reply that failed
+// --json-schema validation.
+func repairPrompt(errs []string) string {
+	return "Your reply does not match the required JSON Schema:\n- " + strings.Join(errs, "\n- ") +
+		"\nReply again with only the corrected JSON."
+}
+
+// ─── Presets ──────────────────────────────────────────────────────────────────
+
+// preset is one entry of presets.json. Zero fields leave the config untouched.
+type preset struct {
+	System      string   `json:"system"`
+	Model       string   `json:"model"`
+	Temperature *float64 `json:"temperature"`
+	MaxTokens   int      `json:"maxTokens"`
+}
+
+func loadPreset(name string) (preset, error) {
+	data, err := os.ReadFile("presets.json")
+	if err != nil {
+		return preset{}, fmt.Errorf("presets: %w", err)
+	}
+	var presets map[string]preset
+	if err := json.Unmarshal(data, &presets); err != nil {
+		return preset{}, fmt.Errorf("presets.json: %w", err)
+	}
+	p, ok := presets[name]
+	if !ok {
+		return preset{}, fmt.Errorf("preset %q not found in presets.json", name)
+	}
+	return p, nil
+}
+
+// applyPreset copies the preset into cfg, skipping fields whose flag name is
+// in keep, and describes every value it changed.
+func applyPreset(cfg *config, p preset, keep map[string]bool) []string {
+	var changes []string
+	if p.System != "" && !keep["system"] && !keep["system-file"] && (p.System != cfg.system || cfg.systemText != "") {
+		changes = append(changes, fmt.Sprintf("system: %q", truncate(p.System, 60)))
+		cfg.system = p.System
+		cfg.systemFile, cfg.systemText = "", ""
+	}
+	if p.Model != "" && !keep["model"] && p.Model != cfg.model {
+		changes = append(changes, fmt.Sprintf("model: %s → %s", cfg.model, p.Model))
+		cfg.model = p.Model
+	}
+	if p.Temperature != nil && !keep["temperature"] && *p.Temperature != cfg.temperature {
+		changes = append(changes, fmt.Sprintf("temperature: %s → %.1f", formatTemp(cfg.temperature), *p.Temperature))
+		cfg.temperature = *p.Temperature
+	}
+	if p.MaxTokens > 0 && !keep["max-tokens"] && p.MaxTokens != cfg.maxTokens {
+		changes = append(changes, fmt.Sprintf("max tokens: %d → %d", cfg.maxTokens, p.MaxTokens))
+		cfg.maxTokens = p.MaxTokens
+	}
+	return changes
+}
+
+func formatTemp(t float64) string {
+	if t < 0 {
+		return "default"
+	}
+	return fmt.Sprintf("%.1f", t)
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// ─── Spend ────────────────────────────────────────────────────────────────────
+
+// spendEntry is one priced request in ~/.challenge_spend.jsonl.
+type spendEntry struct {
+	Time    time.Time `json:"time"`
+	Session string    `json:"session"` // start time of the run
+	Model   string    `json:"model"`
+	In      int       `json:"in"`
+	Out     int       `json:"out"`
+	Cost    float64   `json:"cost"` // estimated USD
+}
+
+func spendFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return home + "/.challenge_spend.jsonl"
+}
+
+// recordSpend appends e to the spend log. Failures are ignored, as with the
+// last question.
+func recordSpend(e spendEntry) {
+	path := spendFile()
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	data, _ := json.Marshal(e)
+	f.Write(append(data, '\n'))
+}
+
+// spendLog records the priced requests of one run in the spend log, under a
+// session id of its own. A nil log records nothing.
+type spendLog struct {
+	session string
+}
+
+// newSpendLog starts a session. Mock and dry runs spend nothing, so they
+// get none.
+func newSpendLog(cfg config) *spendLog {
+	if cfg.mock || cfg.dryRun {
+		return nil
+	}
+	return &spendLog{session: time.Now().Format(time.RFC3339Nano)}
+}
+
+// id is the session id, "" for a nil log.
+func (l *spendLog) id() string {
+	if l == nil {
+		return ""
+	}
+	return l.session
+}
+
+// add records a request to model, priced from the catalog. Models without
+// a known price are left out.
+func (l *spendLog) add(model string, u usage) {
+	if costIn, costOut, ok := catalogPrice(model); ok {
+		l.addMetrics(&metrics{model: model, inputTokens: u.inputTokens, outputTokens: u.outputTokens, costIn: costIn, costOut: costOut})
+	}
+}
+
+// addMetrics records a request at the prices in m, as comparison panels
+// know them.
+func (l *spendLog) addMetrics(m *metrics) {
+	if l == nil || m.inputTokens+m.outputTokens == 0 || m.costIn+m.costOut == 0 {
+		return
+	}
+	recordSpend(spendEntry{
+		Time: time.Now(), Session: l.session, Model: m.model,
+		In: m.inputTokens, Out: m.outputTokens, Cost: m.totalCost(),
+	})
+}
+
+// loadSpend reads the spend log, skipping lines it can't parse. A missing
+// log is no spend yet.
+func loadSpend() ([]spendEntry, error) {
+	data, err := os.ReadFile(spendFile())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []spendEntry
+	for _, line := range strings.Split(string(data), "\n") {
+		var e spendEntry
+		if json.Unmarshal([]byte(line), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// spendReport totals the entries for one session (labelled name), for the
+// day of now and for its month, in local time.
+func spendReport(entries []spendEntry, session, name string, now time.Time) string {
+	type total struct {
+		cost     float64
+		requests int
+	}
+	var sess, day, month total
+	y, m, d := now.Date()
+	for _, e := range entries {
+		add := func(t *total) { t.cost, t.requests = t.cost+e.Cost, t.requests+1 }
+		if e.Session == session {
+			add(&sess)
+		}
+		if ey, em, ed := e.Time.Local().Date(); ey == y && em == m {
+			add(&month)
+			if ed == d {
+				add(&day)
+			}
+		}
+	}
+	var b strings.Builder
+	b.WriteString("Estimated spend:\n")
+	for _, row := range []struct {
+		name string
+		t    total
+	}{{name, sess}, {"Today", day}, {now.Format("January"), month}} {
+		requests := "requests"
+		if row.t.requests == 1 {
+			requests = "request"
+		}
+		fmt.Fprintf(&b, "  %-13s ~$%.4f (%d %s)\n", row.name, row.t.cost, row.t.requests, requests)
+	}
+	return b.String()
+}
+
+// ─── Last question ────────────────────────────────────────────────────────────
+
+// lastRun is the most recent question and the settings it ran with, kept in
+// ~/.challenge_last.json for --last and /again.
+type lastRun struct {
+	Mode        string  `json:"mode"` // chat, compare, temp or models
+	Question    string  `json:"question"`
+	Model       string  `json:"model"`
+	MaxTokens   int     `json:"maxTokens"`
+	Temperature float64 `json:"temperature"` // negative: API default
+	System      string  `json:"system,omitempty"`
+	Format      string  `json:"format,omitempty"`
+	Stop        string  `json:"stop,omitempty"`
+}
+
+func lastRunFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return home + "/.challenge_last.json"
+}
+
+// saveLastRun records question as the last one asked. Failures are ignored,
+// as with the input history.
+func saveLastRun(mode, question string, cfg config) {
+	path := lastRunFile()
+	if path == "" {
+		return
+	}
+	system := cfg.system
+	if cfg.systemText != "" {
+		system = cfg.systemText
+	}
+	data, _ := json.MarshalIndent(lastRun{
+		Mode: mode, Question: question, Model: cfg.model, MaxTokens: cfg.maxTokens,
+		Temperature: cfg.temperature, System: system, Format: cfg.format, Stop: cfg.stop,
+	}, "", "  ")
+	os.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+func loadLastRun() (lastRun, error) {
+	var last lastRun
+	data, err := os.ReadFile(lastRunFile())
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return last, errors.New("no previous question yet")
+		}
+		return last, err
+	}
+	if err := json.Unmarshal(data, &last); err != nil {
+		return last, fmt.Errorf("%s: %w", lastRunFile(), err)
+	}
+	return last, nil
+}
+
+// input is the chat line that asks the question again in its mode.
+func (l lastRun) input() string {
+	if l.Mode == "chat" {
+		return l.Question
+	}
+	return "/" + l.Mode + " " + l.Question
+}
+
+// changes describes how cfg differs from the settings of the last run, so a
+// re-run shows what the tweak was.
+func (l lastRun) changes(cfg config) []string {
+	var changes []string
+	if l.Model != cfg.model {
+		changes = append(changes, fmt.Sprintf("model: %s → %s", l.Model, cfg.model))
+	}
+	if l.MaxTokens != cfg.maxTokens {
+		changes = append(changes, fmt.Sprintf("max tokens: %d → %d", l.MaxTokens, cfg.maxTokens))
+	}
+	if l.Temperature != cfg.temperature {
+		changes = append(changes, fmt.Sprintf("temperature: %s → %s", formatTemp(l.Temperature), formatTemp(cfg.temperature)))
+	}
+	system := cfg.system
+	if cfg.systemText != "" {
+		system = cfg.systemText
+	}
+	if l.System != system {
+		changes = append(changes, fmt.Sprintf("system: %q → %q", truncate(l.System, 30), truncate(system, 30)))
+	}
+	if l.Format != cfg.format {
+		changes = append(changes, fmt.Sprintf("format: %q → %q", l.Format, cfg.format))
+	}
+	if l.Stop != cfg.stop {
+		changes = append(changes, fmt.Sprintf("stop: %q → %q", l.Stop, cfg.stop))
+	}
+	return changes
+}
+
+// printAgain announces a re-run of the last question.
+func printAgain(l lastRun, cfg config) {
+	fmt.Printf("Again (%s): %s\n", l.Mode, truncate(l.Question, 70))
+	for _, c := range l.changes(cfg) {
+		fmt.Println("  " + c)
+	}
+}
+
+// ─── App ──────────────────────────────────────────────────────────────────────
+
+// Exit codes, so scripts and CI can tell failures apart.
+const (
+	exitOK      = 0
+	exitUsage   = 1 // bad flags, missing API key, unreadable input file
+	exitRequest = 2 // a request failed: network error or broken stream
+	exitAPI     = 3 // the API answered with an error status
+	exitPartial = 4 // a batch finished, but some of its requests failed
+)
+
+// apiError is an error status returned by an API, with the response body.
+// keyEnv names the env var of the key that was sent, "" if unknown.
+type apiError struct {
+	status int
+	body   string
+	keyEnv string
+}
+
+func (e *apiError) Error() string { return classifyAPIError(e.status, e.body, e.keyEnv) }
+
+// classifyAPIError turns an error status into a message a user can act on.
+// Auth failures drop the body, 400 and 404 show just the API's
+// error.message; other statuses keep the raw body.
+func classifyAPIError(status int, body, keyEnv string) string {
+	var parsed struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.Unmarshal([]byte(body), &parsed)
+	msg := strings.TrimSpace(parsed.Error.Message)
+	if keyEnv == "" {
+		keyEnv = "the API key"
+	}
+
+	switch status {
+	case 401, 403:
+		return fmt.Sprintf("Authentication failed (%d) — check %s in .env or the environment", status, keyEnv)
+	case 400:
+		if msg != "" {
+			return "Bad request: " + msg
+		}
+	case 404:
+		if msg != "" {
+			return fmt.Sprintf("Not found (404): %s — check the model name and base URL", msg)
+		}
+		return "Not found (404) — check the model name and base URL"
+	}
+	return fmt.Sprintf("API error (%d): %s", status, body)
+}
+
+// partialError reports a batch in which some requests failed.
+type partialError struct {
+	failed, total int
+}
+
+func (e *partialError) Error() string {
+	return fmt.Sprintf("%d of %d requests failed", e.failed, e.total)
+}
+
+// exitCode maps an error that reached main onto an exit code.
+func exitCode(err error) int {
+	var ae *apiError
+	var pe *partialError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &pe):
+		return exitPartial
+	case errors.As(err, &ae):
+		return exitAPI
+	}
+	return exitRequest
+}
+
+func main() {
+	cfg := parseArgs()
+
+	if cfg.systemFile != "" {
+		text, err := readSystemFile(cfg.systemFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+		cfg.systemText = text
+	}
+
+	if cfg.spend {
+		entries, err := loadSpend()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+		session := ""
+		if len(entries) > 0 {
+			session = entries[len(entries)-1].Session
+		}
+		fmt.Print(spendReport(entries, session, "Last session", time.Now()))
+		return
+	}
+
+	if cfg.replay != "" {
+		if err := runReplay(cfg.replay, stdin); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+		return
+	}
+
+	apiKey := getenv("ANTHROPIC_API_KEY")
+	if apiKey == "" && (cfg.mock || cfg.dryRun) {
+		apiKey = "mock"
+	}
+	if apiKey == "" {
+		fmt.Fprintln(os.Stderr, "ANTHROPIC_API_KEY not set in .env or the environment")
+		os.Exit(exitUsage)
+	}
+	openaiKey := getenv("OPENAI_API_KEY")
+	addSecret(apiKey)
+	addSecret(openaiKey)
+
+	if cfg.countTokens != "" {
+		fmt.Println(tokenReport(apiKey, bareConfig(cfg, cfg.maxTokens), []message{{Role: "user", Content: cfg.countTokens}}))
+		return
+	}
+
+	first := "" // chat input to run before the first prompt
+	if cfg.last {
+		last, err := loadLastRun()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+		printAgain(last, cfg)
+		switch last.Mode {
+		case "compare":
+			cfg.compare = last.Question
+		case "temp":
+			cfg.tempCompare = last.Question
+		case "models":
+			cfg.modelCompare = last.Question
+		default:
+			first = last.Question
+		}
+	}
+
+	if cfg.check {
+		if err := checkModels(checkedModels(apiKey, openaiKey, cfg), cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", redact(err.Error()))
+			os.Exit(exitCode(err))
+		}
+	}
+
+	if cfg.compare != "" {
+		saveLastRun("compare", cfg.compare, cfg)
+		if err := runComparison(apiKey, cfg, cfg.compare, stdin); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", redact(err.Error()))
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	if cfg.tempCompare != "" {
+		saveLastRun("temp", cfg.tempCompare, cfg)
+		if err := runTempComparison(apiKey, cfg, cfg.tempCompare, stdin); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", redact(err.Error()))
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	if cfg.batch != "" {
+		if err := runBatch(apiKey, openaiKey, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", redact(err.Error()))
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	if cfg.modelCompare != "" {
+		saveLastRun("models", cfg.modelCompare, cfg)
+		if err := runModelComparison(apiKey, openaiKey, cfg, cfg.modelCompare, stdin); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", redact(err.Error()))
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	printBanner(cfg, openaiKey)
+	if err := runChat(apiKey, openaiKey, cfg, first); err != nil {
+		os.Exit(exitCode(err)) // already reported when it happened
+	}
+}
+
+// flagUsage prints fs's flags as flag.PrintDefaults does, leaving out hidden.
+func flagUsage(fs *flag.FlagSet, hidden ...string) func() {
+	return func() {
+		shown := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+		fs.VisitAll(func(f *flag.Flag) {
+			if !slices.Contains(hidden, f.Name) {
+				shown.Var(f.Value, f.Name, f.Usage)
+				shown.Lookup(f.Name).DefValue = f.DefValue // not whatever was parsed before -h
+			}
+		})
+		shown.SetOutput(fs.Output())
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		shown.PrintDefaults()
+	}
+}
+
+func parseArgs() config {
+	cfg := config{}
+	flag.StringVar(&cfg.model, "model", defaultModel, "Anthropic model")
+	flag.StringVar(&cfg.preset, "preset", "", "apply a named preset from presets.json")
+	flag.IntVar(&cfg.maxTokens, "max-tokens", 1024, "max response tokens")
+	flag.StringVar(&cfg.system, "system", "", "system prompt")
+	flag.StringVar(&cfg.systemFile, "system-file", "", "read system prompt from file")
+	flag.StringVar(&cfg.stop, "stop", "", "stop sequence")
+	flag.StringVar(&cfg.format, "format", "", "response format instruction")
+	flag.Float64Var(&cfg.temperature, "temperature", -1, "sampling temperature (0.0–1.0, default: API default)")
+	flag.StringVar(&cfg.compare, "compare", "", "run 5-way comparison and exit")
+	flag.IntVar(&cfg.samples, "samples", 3, "answers sampled by the self-consistency panel (2–10)")
+	flag.StringVar(&cfg.panelTokens, "panel-tokens", "", "max tokens per comparison panel in order, e.g. ,,,2048 (empty: --max-tokens, twice that for the expert panel)")
+	flag.StringVar(&cfg.panelModels, "panel-models", "", "model per comparison panel in order, e.g. haiku,,opus (empty: --model)")
+	flag.StringVar(&cfg.panelTemps, "panel-temps", "", "temperature per comparison panel in order, e.g. ,,,,1 (empty: --temperature)")
+	flag.StringVar(&cfg.expected, "expected", "", "known answer (or /regex/) to mark comparison panels ✓/✗")
+	flag.StringVar(&cfg.tempCompare, "tempcompare", "", "run 3-way temperature comparison and exit")
+	flag.StringVar(&cfg.modelCompare, "models", "", "run the model comparison (Gemini too with GEMINI_API_KEY) and exit")
+	flag.StringVar(&cfg.lineup, "lineup", "", "models to compare, e.g. groq:llama-3.3-70b,openai:gpt-4o-mini,anthropic:sonnet")
+	flag.IntVar(&cfg.repeat, "repeat", 1, "run each model N times in the model comparison and report timing statistics")
+	flag.StringVar(&cfg.saveCmp, "save-cmp", "", "save each finished comparison to this .cmp.json file")
+	flag.StringVar(&cfg.replay, "replay", "", "reopen a saved .cmp.json comparison and exit")
+	flag.StringVar(&cfg.batch, "batch", "", "run the model comparison headlessly on each line of this file and exit")
+	flag.StringVar(&cfg.metricsOut, "metrics-out", "", "CSV file --batch appends metrics to (default: stdout)")
+	flag.BoolVar(&cfg.failFast, "fail-fast", false, "in comparisons and --batch, stop everything at the first failed request")
+	flag.BoolVar(&cfg.verbose, "verbose", false, "print each request as curl before sending")
+	flag.Float64Var(&cfg.costWarn, "cost-warn", 0, "ask before sending a chat request whose estimated input cost is above this many dollars")
+	flag.IntVar(&cfg.contextLimit, "context-limit", 0, "trim old history above this many (approx.) tokens")
+	flag.BoolVar(&cfg.summarizeOld, "summarize-old", false, "summarize trimmed history instead of dropping it")
+	flag.IntVar(&cfg.typingDelay, "typing-delay", 0, "pause in ms between printed words (terminal only)")
+	flag.StringVar(&cfg.bell, "bell", "", "alert when a reply finishes: beep, flash or notify")
+	flag.StringVar(&cfg.flush, "flush", "lines", `print streamed replies by complete "lines" or also partial "words" of long lines`)
+	flag.BoolVar(&cfg.spend, "spend", false, "report today's, the last session's and this month's estimated spend and exit")
+	flag.StringVar(&cfg.countTokens, "count-tokens", "", "print the token count of this text and exit")
+	flag.BoolVar(&cfg.thinking, "thinking", false, "show the reasoning that reasoning models stream (reasoning_content) in a box above the answer")
+	flag.BoolVar(&cfg.last, "last", false, "ask the previous question again, in the same mode, with the current flags")
+	flag.StringVar(&cfg.historyFile, "history-file", defaultHistoryFile(), `prompt history file, "" to not save one (default: CHALLENGE_HISTORY or ~/.challenge_history)`)
+	flag.IntVar(&cfg.historySize, "history-size", editorHistoryMax, "prompt history lines to keep; older ones are trimmed")
+	flag.StringVar(&cfg.userLabel, "user-label", "You", "chat prompt label for your turns")
+	flag.StringVar(&cfg.replyLabel, "assistant-label", "", "chat prompt label for replies (default: from the model, e.g. Claude or GPT)")
+	flag.BoolVar(&cfg.suggest, "suggest", false, "after each reply, suggest 3 follow-up questions; type 1-3 to ask one")
+	flag.BoolVar(&cfg.noStream, "no-stream", false, "request each chat reply in one piece (stream: false) and print it when complete")
+	flag.BoolVar(&cfg.prettyJSON, "pretty-json", false, "after a reply that is JSON, reprint it indented and colored (on by default when --format mentions json)")
+	flag.StringVar(&cfg.jsonSchema, "json-schema", "", "check JSON chat replies against this JSON Schema file and offer to re-ask on errors")
+	flag.BoolVar(&cfg.pager, "pager", false, "show each chat reply through $PAGER (less) once it is complete instead of streaming it")
+	flag.StringVar(&cfg.anthropicURL, "anthropic-base-url", "", "Anthropic-compatible base URL, e.g. a LiteLLM gateway (default: ANTHROPIC_BASE_URL or api.anthropic.com)")
+	flag.StringVar(&cfg.apiVersion, "api-version", "2023-06-01", "anthropic-version header")
+	flag.Var(&cfg.betas, "beta", "anthropic-beta feature (repeatable)")
+	flag.BoolVar(&cfg.strictStream, "strict-stream", false, "report SSE events dropped as unparseable at the end of each stream")
+	flag.StringVar(&cfg.debugLog, "debug-log", "", "append every request, response status and SSE event to this JSONL file")
+	flag.StringVar(&cfg.extraJSON, "extra-json", "", `JSON object merged into each Anthropic request, e.g. '{"top_k":20}'`)
+	flag.BoolVar(&cfg.check, "check", false, "check that the model(s) exist and the provider answers before starting")
+	flag.BoolVar(&cfg.dryRun, "dry-run", false, "show each request (key-redacted) instead of sending it")
+	flag.BoolVar(&cfg.mock, "mock", false, "offline: answer every request with a canned stream (for demos and UI work)")
+	flag.StringVar(&cfg.theme, "theme", "default", "color theme: "+themeNames())
+	flag.BoolVar(&cfg.noColor, "no-color", false, "disable colors (same as NO_COLOR)")
+	flag.BoolVar(&renderOpts.math, "math", false, "render LaTeX math as Unicode (best effort)")
+	flag.BoolVar(&renderOpts.linkRefs, "link-refs", false, "show links as numbered footnotes after each reply")
+	flag.BoolVar(&renderOpts.compact, "compact", false, "collapse runs of blank lines in replies")
+	flag.IntVar(&renderOpts.tabStop, "tabstop", 4, "expand tabs in replies and panels to multiples of this many columns")
+	flag.BoolVar(&renderOpts.raw, "no-render", false, "print replies as raw markdown (toggle in chat with /raw)")
+	flag.Usage = flagUsage(flag.CommandLine, "mock") // --mock is for demos and UI work, not users
+	flag.Parse()
+
+	pal, ok := themes[cfg.theme]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown theme %q (available: %s)\n", cfg.theme, themeNames())
+		os.Exit(exitUsage)
+	}
+	depth := detectColor()
+	if cfg.noColor {
+		depth = colorNone
+	}
+	activeTheme = pal.resolve(depth)
+
+	if cfg.mock {
+		cfg.client = mockDoer{}
+	}
+	if cfg.dryRun {
+		cfg.client = dryRunDoer{}
+	}
+	cfg.ledger = newSpendLog(cfg)
+	if cfg.debugLog != "" {
+		f, err := os.OpenFile(cfg.debugLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+		reqLog = &jsonlLog{f: f}
+		cfg.client = loggingDoer{next: cfg.httpClient()}
+	}
+	if cfg.anthropicURL == "" {
+		cfg.anthropicURL = getenv("ANTHROPIC_BASE_URL")
+	}
+	if cfg.flush != "lines" && cfg.flush != "words" {
+		fmt.Fprintf(os.Stderr, "Error: --flush must be lines or words, got %q\n", cfg.flush)
+		os.Exit(exitUsage)
+	}
+	if renderOpts.tabStop < 1 {
+		fmt.Fprintf(os.Stderr, "Error: --tabstop must be at least 1, got %d\n", renderOpts.tabStop)
+		os.Exit(exitUsage)
+	}
+	if cfg.costWarn < 0 {
+		fmt.Fprintf(os.Stderr, "Error: --cost-warn must not be negative, got %g\n", cfg.costWarn)
+		os.Exit(exitUsage)
+	}
+	if cfg.samples < 2 || cfg.samples > 10 {
+		fmt.Fprintf(os.Stderr, "Error: --samples must be between 2 and 10, got %d\n", cfg.samples)
+		os.Exit(exitUsage)
+	}
+	if _, err := techniqueConfigs(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitUsage)
+	}
+	if cfg.repeat < 1 {
+		fmt.Fprintf(os.Stderr, "Error: --repeat must be at least 1, got %d\n", cfg.repeat)
+		os.Exit(exitUsage)
+	}
+	if cfg.lineup != "" {
+		if _, err := lineupModels(cfg.lineup); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+	}
+	if _, err := parseExpected(cfg.expected); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(exitUsage)
+	}
+	if cfg.jsonSchema != "" {
+		if _, err := loadSchema(cfg.jsonSchema); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+	}
+	if cfg.extraJSON != "" {
+		extra, err := parseExtraJSON(cfg.extraJSON)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+		var managed []string
+		for _, k := range managedParams {
+			if _, ok := extra[k]; ok {
+				managed = append(managed, k)
+			}
+		}
+		if len(managed) > 0 {
+			fmt.Fprintf(os.Stderr, "Warning: --extra-json overrides %s\n", strings.Join(managed, ", "))
+		}
+	}
+
+	if cfg.preset != "" {
+		p, err := loadPreset(cfg.preset)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(exitUsage)
+		}
+		// Flags given explicitly on the command line win over the preset.
+		set := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		applyPreset(&cfg, p, set)
+	}
+	return cfg
+}
+
+func printBanner(cfg config, openaiKey string) {
+	fmt.Println("=== Claude CLI Chat ===")
+	fmt.Printf("Model:      %s\n", cfg.model)
+	if cfg.preset != "" {
+		fmt.Printf("Preset:     %s\n", cfg.preset)
+	}
+	fmt.Printf("Max tokens: %d\n", cfg.maxTokens)
+	if cfg.systemText != "" {
+		fmt.Printf("System:     (from %s, %d chars)\n", cfg.systemFile, len(cfg.systemText))
+	} else if cfg.system != "" {
+		fmt.Printf("System:     %s\n", cfg.system)
+	}
+	if cfg.temperature >= 0 {
+		fmt.Printf("Temperature:%.1f\n", cfg.temperature)
+	}
+	if cfg.stop != "" {
+		fmt.Printf("Stop:       %q\n", cfg.stop)
+	}
+	if cfg.format != "" {
+		fmt.Printf("Format:     %s\n", cfg.format)
+	}
+	if user, reply := cfg.labels(); user != "You" || reply != "Claude" {
+		fmt.Printf("Labels:     %s / %s\n", user, reply)
+	}
+	if len(cfg.betas) > 0 {
+		fmt.Printf("Betas:      %s\n", cfg.betas.String())
+	}
+	if cfg.verbose {
+		fmt.Printf("Verbose:    on (curl output to stderr)\n")
+	}
+	if openaiKey != "" {
+		fmt.Printf("OpenAI:     loaded\n")
+	}
+	fmt.Println()
+	fmt.Println("Type /help for commands, \"exit\" or \"quit\" to quit.")
+	fmt.Println()
+}
+
+func printHelp() {
+	fmt.Println("Commands:")
+	fmt.Println("  /help                — show this help")
+	fmt.Println("  /clear               — reset conversation history (asks first; /clear! skips)")
+	fmt.Println("  /undo-clear          — restore the history wiped by the last /clear")
+	fmt.Println("  /system [text]       — replace the system prompt, or show what is sent")
+	fmt.Println("  /system+ <text>      — append a line to the system prompt")
+	fmt.Println("  /system-             — clear the system prompt")
+	fmt.Println("  /prompt              — show the model settings and the exact system prompt sent")
+	fmt.Println("  /system-file <path>  — load system prompt from file")
+	fmt.Println("  /branch <name>       — fork the conversation into a new branch")
+	fmt.Println("  /branches            — list branches")
+	fmt.Println("  /switch <name>       — switch to another branch")
+	fmt.Println("  /preset <name>       — apply a preset from presets.json")
+	fmt.Println("  /pipe <cmd>          — re-run the last request, piping the raw reply into cmd")
+	fmt.Println("  /ctx                 — show how much of the context window the history fills")
+	fmt.Println("  /compact             — summarize all but the last exchange into a system note")
+	fmt.Println("  /tokens [text]       — count the tokens of text, or of the conversation so far")
+	fmt.Println("  /set name=value      — define a variable; {name} in a message is replaced by value")
+	fmt.Println("  /unset name          — remove a variable")
+	fmt.Println("  /vars                — list the variables")
+	fmt.Println("  /spend               — show estimated spend this session, today and this month")
+	fmt.Println("  /again               — ask the previous question again (same mode, current settings)")
+	fmt.Println("  /last                — show the last reply again through $PAGER")
+	fmt.Println("  /use <model>         — switch model (sonnet, haiku, opus or an id); @model <q> for one turn")
+	fmt.Println("  /raw                 — toggle raw markdown output (no rendering) for later replies")
+	fmt.Println("  /copy [code]         — copy the last reply (or its last code block) to the clipboard")
+	fmt.Println("  /code [n] <file>     — save code block n of the last reply; /code lists them")
+	fmt.Println("  /compare <question>  — stream 5 reasoning approaches side-by-side")
+	fmt.Println("  /temp <question>     — compare temperature 0 / 0.7 / 1.0 side-by-side")
+	fmt.Println("  /models <question>   — compare weak/medium/strong models side-by-side (+ Gemini if GEMINI_API_KEY is set)")
+	fmt.Println("  exit / quit          — quit")
+	fmt.Println()
+	fmt.Println("While a reply streams: Space pauses and resumes it, Ctrl+C cancels it.")
+	fmt.Println()
+	fmt.Println("Flags (set at startup):")
+	fmt.Println("  --model string      Anthropic model (default " + defaultModel + ")")
+	fmt.Println("  --preset name       apply a preset from presets.json")
+	fmt.Println("  --max-tokens int    max response tokens (default 1024)")
+	fmt.Println("  --system string     system prompt")
+	fmt.Println("  --system-file path  read system prompt from file")
+	fmt.Println("  --stop string       stop sequence")
+	fmt.Println("  --format string     response format instruction")
+	fmt.Println("  --temperature float  sampling temperature (0.0–1.0)")
+	fmt.Println("  --compare string    run 5-way comparison directly and exit")
+	fmt.Println("  --samples int       answers the self-consistency panel samples (default 3)")
+	fmt.Println("  --panel-tokens list max tokens per --compare panel, e.g. ,,,2048 (empty: --max-tokens, 2× for the expert panel)")
+	fmt.Println("  --panel-models list model per --compare panel, e.g. haiku,,opus (empty: --model)")
+	fmt.Println("  --panel-temps list  temperature per --compare panel, e.g. ,,,,1 (empty: --temperature)")
+	fmt.Println("  --expected answer   mark comparison panels ✓/✗ by answer (case-insensitive, or /regex/)")
+	fmt.Println("  --tempcompare str   run 3-way temperature comparison and exit")
+	fmt.Println("  --models string     run the model comparison and exit")
+	fmt.Println("  --lineup list       models for --models/--batch as provider[:model],… (providers:")
+	fmt.Println("                      anthropic, openai, azure, gemini, groq, mistral, together, local)")
+	fmt.Println("  --repeat int        run each model N times in --models; table shows mean/median/stddev")
+	fmt.Println("  --save-cmp file     save finished comparisons to a .cmp.json file")
+	fmt.Println("  --replay file       reopen a saved .cmp.json comparison (no API calls)")
+	fmt.Println("  --batch file        run the model comparison on each line of file, no UI")
+	fmt.Println("  --metrics-out file  CSV that --batch appends rows to (default: stdout)")
+	fmt.Println("  --fail-fast         stop a comparison or --batch at the first failed request")
+	fmt.Println("  --verbose           print each request as curl before sending")
+	fmt.Println("  --cost-warn usd     confirm before sending a request estimated to cost more")
+	fmt.Println("  --context-limit int trim old history above ~N tokens")
+	fmt.Println("  --summarize-old     summarize trimmed history into a system note")
+	fmt.Println("  --typing-delay ms   pace chat output word by word")
+	fmt.Println("  --bell mode         alert on completion: beep, flash or notify")
+	fmt.Println("  --flush mode        lines (default) prints complete lines; words also prints")
+	fmt.Println("                      long lines word by word as they stream")
+	fmt.Println("  --count-tokens text print the token count of text and exit")
+	fmt.Println("  --spend             report estimated spend today, last session and this month")
+	fmt.Println("  --thinking          show reasoning models' thinking above the answer")
+	fmt.Println("  --last              ask the previous question again with the current flags")
+	fmt.Println("  --pager             show complete replies through $PAGER instead of streaming")
+	fmt.Println("  --pretty-json       reprint JSON replies indented and colored (implied by a")
+	fmt.Println("                      --format mentioning json)")
+	fmt.Println("  --json-schema file  check JSON replies against a JSON Schema; on errors, offer")
+	fmt.Println("                      to re-ask with them fed back to the model")
+	fmt.Println("  --history-file path prompt history file; \"\" saves none (default: CHALLENGE_HISTORY")
+	fmt.Println("                      or ~/.challenge_history)")
+	fmt.Println("  --history-size n    prompt history lines to keep (default 500)")
+	fmt.Println("  --user-label str    chat label for your turns (default You)")
+	fmt.Println("  --assistant-label str")
+	fmt.Println("                      chat label for replies (default: from the model)")
+	fmt.Println("  --suggest           suggest 3 follow-ups after each reply; type 1-3 to ask one")
+	fmt.Println("  --no-stream         request whole chat replies (stream: false), printed at once")
+	fmt.Println("  --debug-log file    log requests, SSE events and parse errors as JSONL")
+	fmt.Println("  --strict-stream     report stream events dropped as unparseable")
+	fmt.Println("  --extra-json obj    merge a JSON object into each Anthropic request (top_k, metadata…)")
+	fmt.Println("  --check             verify the model(s) exist before starting (fails early)")
+	fmt.Println("  --dry-run           show each request (keys redacted) instead of sending it")
+	fmt.Println("  --anthropic-base-url url")
+	fmt.Println("                      Anthropic-compatible gateway (default: ANTHROPIC_BASE_URL)")
+	fmt.Println("  --api-version str   anthropic-version header (default 2023-06-01)")
+	fmt.Println("  --beta feature      anthropic-beta feature, repeatable")
+	fmt.Println("  --theme name        color theme: " + themeNames())
+	fmt.Println("  --no-color          disable colors (also honors NO_COLOR)")
+	fmt.Println("  --math              render LaTeX math ($x^2$, \\frac, \\alpha) as Unicode")
+	fmt.Println("  --link-refs         show [text](url) as text[n] with footnotes after the reply")
+	fmt.Println("  --compact           collapse runs of blank lines (not inside code blocks)")
+	fmt.Println("  --tabstop n         expand tabs to every n columns (default 4)")
+	fmt.Println("  --no-render         print replies as raw markdown (toggle with /raw)")
+	fmt.Println()
+}
+
+func buildSystemPrompt(cfg config) string {
+	parts := []string{}
+	if cfg.systemText != "" {
+		parts = append(parts, cfg.systemText)
+	} else if cfg.system != "" {
+		parts = append(parts, cfg.system)
+	}
+	if cfg.format != "" {
+		parts = append(parts, "Always respond in this format: "+cfg.format)
+	}
+	if cfg.stop != "" {
+		parts = append(parts, "Always end your response with: "+cfg.stop)
+	}
+	if cfg.summary != "" {
+		parts = append(parts, "Summary of the earlier conversation:\n"+cfg.summary)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// expandVars replaces each {name} in s with its variable. Placeholders with
+// no variable are left as they are and returned in unknown, once each.
+func expandVars(s string, vars map[string]string) (out string, unknown []string) {
+	out = reVarRef.ReplaceAllStringFunc(s, func(m string) string {
+		name := m[1 : len(m)-1]
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		if !slices.Contains(unknown, name) {
+			unknown = append(unknown, name)
+		}
+		return m
+	})
+	return out, unknown
+}
+
+// printSystemPrompt shows the system prompt as it is sent, with the format
+// and stop instructions and any history summary composed in.
+func printSystemPrompt(cfg config) {
+	sys := buildSystemPrompt(cfg)
+	if sys == "" {
+		fmt.Print("No system prompt is sent.\n\n")
+		return
+	}
+	fmt.Printf("Sent as:\n\033[2m%s\033[0m\n\n", sys)
+}
+
+// normalizeInput cleans up typed, pasted or file text before it is sent:
+// CRLF and stray \r become \n, trailing whitespace is cut from every line
+// and the text is trimmed. Indentation and blank lines inside are kept.
+func normalizeInput(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRightFunc(l, unicode.IsSpace)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+func readSystemFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("system prompt file: %w", err)
+	}
+	text := normalizeInput(string(data))
+	if text == "" {
+		return "", fmt.Errorf("system prompt file %s is empty", path)
+	}
+	return text, nil
+}
+
+// sessionStats adds up a chat session for the summary printed on exit.
+type sessionStats struct {
+	start    time.Time
+	turns    int
+	in, out  int     // tokens
+	cost     float64 // USD, for the turns whose model has a known price
+	unpriced int     // turns whose model has no known price
+	log      *spendLog
+}
+
+func (s *sessionStats) add(model string, u usage) {
+	s.turns++
+	if !s.count(model, u) {
+		s.unpriced++
+		return
+	}
+	s.log.add(model, u)
+}
+
+// addSide counts a side request, such as the --suggest follow-ups, which is
+// no turn of its own and already in the spend log.
+func (s *sessionStats) addSide(model string, u usage) {
+	s.count(model, u)
+}
+
+// count adds u's tokens, and their cost if model has a known price.
+func (s *sessionStats) count(model string, u usage) bool {
+	s.in += u.inputTokens
+	s.out += u.outputTokens
+	costIn, costOut, ok := catalogPrice(model)
+	if ok {
+		m := metrics{inputTokens: u.inputTokens, outputTokens: u.outputTokens, costIn: costIn, costOut: costOut}
+		s.cost += m.totalCost()
+	}
+	return ok
+}
+
+// print shows the summary, or nothing if no reply came back.
+func (s *sessionStats) print() {
+	if s.turns == 0 {
+		return
+	}
+	cost := fmt.Sprintf("~$%.4f", s.cost)
+	if s.unpriced == s.turns {
+		cost = "cost unknown"
+	} else if s.unpriced > 0 {
+		cost += fmt.Sprintf(" (+%d unpriced)", s.unpriced)
+	}
+	turns := "turns"
+	if s.turns == 1 {
+		turns = "turn"
+	}
+	fmt.Printf("\033[2mSession: %d %s · %s in / %s out tokens · %s · %s\033[0m\n",
+		s.turns, turns, formatTokens(s.in), formatTokens(s.out), cost, time.Since(s.start).Round(time.Second))
+}
+
+// thread is one line of conversation: its messages and the summary of the
+// turns /compact or --summarize-old folded out of them, which is sent with
+// the system prompt and so has to travel with the messages.
+type thread struct {
+	history []message
+	summary string
+}
+
+// runChat runs the interactive loop, starting with first when it is set. It
+// returns the error of the last request when that one failed, so a scripted
+// session that ends on a failure exits non-zero; one that recovered doesn't.
+func runChat(apiKey, openaiKey string, cfg config, first string) error {
+	editor := newLineEditor(cfg.historyFile, cfg.historySize)
+	var history []message
+	var cleared *thread // last cleared history, for /undo-clear
+	branch := "main"
+	branches := map[string]thread{}
+	var window contextUse // context window use as of the last reply
+	var failed error
+	stats := sessionStats{start: time.Now(), log: cfg.ledger}
+	var suggestions []string // --suggest follow-ups to the last reply
+	var schema map[string]any
+	if cfg.jsonSchema != "" {
+		schema, _ = loadSchema(cfg.jsonSchema) // validated in parseArgs
+	}
+	vars := map[string]string{} // /set variables for {name} in messages
+	var repair string           // --json-schema fix-up to send as the next turn
+
+	for {
+		userLabel, replyLabel := cfg.labels() // a preset may change the model
+		prompt := fmt.Sprintf("%s [%s]: ", userLabel, modelAlias(cfg.model))
+		var line string
+		var err error
+		internal := repair != "" // not typed, so kept out of history and last-run
+		if internal {
+			line, repair = repair, ""
+			fmt.Println("\033[2m→ asking for a corrected reply\033[0m")
+		} else if first != "" {
+			line, first = first, ""
+			fmt.Println(prompt + line)
+		} else {
+			line, err = editor.readLine(prompt)
+		}
+		if err == io.EOF {
+			// Ctrl+D or the end of piped input. In raw mode the editor has
+			// already moved to a new line.
+			if !editor.raw {
+				fmt.Println()
+			}
+			stats.print()
+			fmt.Println("Goodbye!")
+			return failed
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "\nError reading input:", err)
+			return err
+		}
+		input := normalizeInput(line)
+		if input == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(input); err == nil && n >= 1 && n <= len(suggestions) {
+			input = suggestions[n-1]
+			fmt.Printf("\033[2m→ %s\033[0m\n", input)
+		}
+		suggestions = nil
+		if !internal {
+			editor.add(input)
+		}
+
+		switch {
+		case internal: // a fix-up is never a command
+		case input == "exit" || input == "quit":
+			stats.print()
+			fmt.Println("Goodbye!")
+			return failed
+		case input == "/help":
+			printHelp()
+			continue
+		case input == "/clear" || input == "/clear!" || input == "/clear --force":
+			if len(history) == 0 && cfg.summary == "" {
+				fmt.Println("History is already empty.")
+				fmt.Println()
+				continue
+			}
+			if input == "/clear" {
+				answer, err := editor.readLine(fmt.Sprintf("Clear %d messages? (y/N) ", len(history)))
+				if err != nil || !strings.EqualFold(strings.TrimSpace(answer), "y") {
+					fmt.Println("Kept history.")
+					fmt.Println()
+					continue
+				}
+			}
+			cleared = &thread{history: history, summary: cfg.summary}
+			history, cfg.summary = nil, ""
+			window = contextUse{}
+			fmt.Println("History cleared. /undo-clear restores it.")
+			fmt.Println()
+			continue
+		case input == "/undo-clear":
+			if cleared == nil {
+				fmt.Println("Nothing to restore.")
+			} else {
+				history, cfg.summary = cleared.history, cleared.summary
+				cleared = nil
+				window = contextUse{}
+				fmt.Printf("Restored %d messages.\n", len(history))
+			}
+			fmt.Println()
+			continue
+		case input == "/system":
+			printSystemPrompt(cfg)
+			continue
+		case input == "/prompt":
+			fmt.Printf("Model:       %s\n", cfg.model)
+			fmt.Printf("Temperature: %s\n", formatTemp(cfg.temperature))
+			fmt.Printf("Max tokens:  %d\n", cfg.maxTokens)
+			printSystemPrompt(cfg)
+			continue
+		case strings.HasPrefix(input, "/system "):
+			cfg.system = strings.TrimPrefix(input, "/system ")
+			cfg.systemFile, cfg.systemText = "", ""
+			fmt.Print("System prompt updated. ")
+			printSystemPrompt(cfg)
+			continue
+		case input == "/system+" || strings.HasPrefix(input, "/system+ "):
+			text := strings.TrimSpace(strings.TrimPrefix(input, "/system+"))
+			if text == "" {
+				fmt.Println("Usage: /system+ <text> (appends a line to the system prompt)")
+				fmt.Println()
+				continue
+			}
+			base := cfg.system
+			if cfg.systemText != "" {
+				base = cfg.systemText
+			}
+			if base != "" {
+				text = base + "\n" + text
+			}
+			cfg.system = text
+			cfg.systemFile, cfg.systemText = "", ""
+			fmt.Print("System prompt extended. ")
+			printSystemPrompt(cfg)
+			continue
+		case input == "/system-":
+			cfg.system, cfg.systemFile, cfg.systemText = "", "", ""
+			fmt.Print("System prompt cleared. ")
+			printSystemPrompt(cfg)
+			continue
+		case input == "/branches":
+			branches[branch] = thread{history: history, summary: cfg.summary}
+			names := make([]string, 0, len(branches))
+			for name := range branches {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				mark := " "
+				if name == branch {
+					mark = "*"
+				}
+				fmt.Printf("%s %s (%d messages)\n", mark, name, len(branches[name].history))
+			}
+			fmt.Println()
+			continue
+		case strings.HasPrefix(input, "/branch "):
+			name := strings.TrimSpace(strings.TrimPrefix(input, "/branch "))
+			if _, exists := branches[name]; exists || name == branch {
+				fmt.Printf("Branch %q already exists; use /switch.\n\n", name)
+				continue
+			}
+			branches[branch] = thread{history: history, summary: cfg.summary}
+			history = slices.Clone(history)
+			branch = name
+			fmt.Printf("Forked %d messages into branch %q.\n\n", len(history), name)
+			continue
+		case strings.HasPrefix(input, "/switch "):
+			name := strings.TrimSpace(strings.TrimPrefix(input, "/switch "))
+			target, ok := branches[name]
+			if !ok {
+				fmt.Printf("No branch %q; see /branches.\n\n", name)
+				continue
+			}
+			branches[branch] = thread{history: history, summary: cfg.summary}
+			history, cfg.summary, branch = target.history, target.summary, name
+			window = contextUse{}
+			fmt.Printf("Switched to branch %q (%d messages).\n", name, len(history))
+			printTail(history, 2, cfg)
+			fmt.Println()
+			continue
+		case strings.HasPrefix(input, "/preset "):
+			name := strings.TrimSpace(strings.TrimPrefix(input, "/preset "))
+			p, err := loadPreset(name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				fmt.Println()
+				continue
+			}
+			cfg.preset = name
+			changes := applyPreset(&cfg, p, nil)
+			if len(changes) == 0 {
+				fmt.Printf("Preset %q applied (no changes).\n\n", name)
+				continue
+			}
+			fmt.Printf("Preset %q applied:\n", name)
+			for _, c := range changes {
+				fmt.Println("  " + c)
+			}
+			fmt.Println()
+			continue
+		case strings.HasPrefix(input, "/system-file "):
+			path := strings.TrimSpace(strings.TrimPrefix(input, "/system-file "))
+			text, err := readSystemFile(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				fmt.Println()
+				continue
+			}
+			cfg.systemFile, cfg.systemText = path, text
+			fmt.Printf("System prompt loaded from %s (%d chars)\n\n", path, len(text))
+			continue
+		case strings.HasPrefix(input, "/pipe "):
+			command := strings.TrimSpace(strings.TrimPrefix(input, "/pipe "))
+			if len(history) == 0 || history[len(history)-1].Role != "assistant" {
+				fmt.Println("No reply to pipe yet.")
+				fmt.Println()
+				continue
+			}
+			fmt.Print("\n" + replyLabel + ": ")
+			reply, err := pipeReply(apiKey, cfg, history[:len(history)-1], command)
+			if err != nil {
+				failed = err
+				fmt.Fprintln(os.Stderr, "\nError:", redact(err.Error()))
+				fmt.Println()
+				continue
+			}
+			failed = nil
+			if reply != "" {
+				history[len(history)-1].Content = reply
+			}
+			fmt.Println()
+			printLinkNotes(reply)
+			continue
+		case input == "/ctx":
+			fmt.Println(window.status(cfg, history))
+			fmt.Println()
+			continue
+		case input == "/compact":
+			// Unlike --context-limit trimming this runs on demand and always
+			// summarizes; the last exchange stays verbatim.
+			if len(history) < 4 {
+				fmt.Println("Nothing to compact yet; the last exchange is always kept.")
+				fmt.Println()
+				continue
+			}
+			older, recent := history[:len(history)-2], history[len(history)-2:]
+			before := estimateTokens(cfg, history)
+			summary, err := summarize(apiKey, cfg, cfg.summary, older)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", redact(err.Error()))
+				fmt.Println()
+				continue
+			}
+			cfg.summary = summary
+			history = recent
+			window = contextUse{}
+			fmt.Printf("Compacted %d messages into a summary: ~%d → ~%d tokens.\n\n", len(older), before, estimateTokens(cfg, history))
+			continue
+		case strings.HasPrefix(input, "/set "):
+			name, value, ok := strings.Cut(strings.TrimPrefix(input, "/set "), "=")
+			name = strings.TrimSpace(name)
+			if !ok || !reVarName.MatchString(name) {
+				fmt.Println("Usage: /set name=value (name: letters, digits and _)")
+			} else {
+				vars[name] = strings.TrimSpace(value)
+				fmt.Printf("{%s} = %s\n", name, vars[name])
+			}
+			fmt.Println()
+			continue
+		case strings.HasPrefix(input, "/unset "):
+			name := strings.TrimSpace(strings.TrimPrefix(input, "/unset "))
+			if _, ok := vars[name]; !ok {
+				fmt.Printf("No variable %q.\n\n", name)
+				continue
+			}
+			delete(vars, name)
+			fmt.Printf("Removed {%s}.\n\n", name)
+			continue
+		case input == "/vars":
+			if len(vars) == 0 {
+				fmt.Println("No variables; /set name=value defines one.")
+			}
+			for _, name := range slices.Sorted(maps.Keys(vars)) {
+				fmt.Printf("  {%s} = %s\n", name, vars[name])
+			}
+			fmt.Println()
+			continue
+		case input == "/spend":
+			entries, err := loadSpend()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+			}
+			fmt.Println(spendReport(entries, cfg.ledger.id(), "This session", time.Now()))
+			continue
+		case input == "/tokens" || strings.HasPrefix(input, "/tokens "):
+			if text := strings.TrimSpace(strings.TrimPrefix(input, "/tokens")); text != "" {
+				fmt.Println(tokenReport(apiKey, bareConfig(cfg, cfg.maxTokens), []message{{Role: "user", Content: text}}))
+			} else if len(history) == 0 {
+				fmt.Println("Nothing to count yet; /tokens <text> counts text.")
+			} else {
+				fmt.Printf("Conversation: %s\n", tokenReport(apiKey, cfg, history))
+			}
+			fmt.Println()
+			continue
+		case input == "/again":
+			last, err := loadLastRun()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				fmt.Println()
+				continue
+			}
+			printAgain(last, cfg)
+			first = last.input()
+			continue
+		case input == "/last":
+			if len(history) == 0 || history[len(history)-1].Role != "assistant" {
+				fmt.Println("No reply to show yet.")
+				fmt.Println()
+				continue
+			}
+			if err := pageText(renderReply(history[len(history)-1].Content)); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+			}
+			fmt.Println()
+			continue
+		case input == "/use":
+			fmt.Printf("Model: %s\n\n", cfg.model)
+			continue
+		case strings.HasPrefix(input, "/use "):
+			name := strings.TrimSpace(strings.TrimPrefix(input, "/use "))
+			model, ok := anthropicModel(name)
+			if !ok {
+				fmt.Printf("Unknown model %q (try sonnet, haiku, opus or a claude-… id).\n\n", name)
+				continue
+			}
+			cfg.model = model
+			fmt.Printf("Model: %s\n\n", model)
+			continue
+		case input == "/raw":
+			renderOpts.raw = !renderOpts.raw
+			if renderOpts.raw {
+				fmt.Println("Raw output on: replies print as markdown source.")
+			} else {
+				fmt.Println("Raw output off: replies are rendered.")
+			}
+			fmt.Println()
+			continue
+		case input == "/copy" || input == "/copy code":
+			if len(history) == 0 || history[len(history)-1].Role != "assistant" {
+				fmt.Println("No reply to copy yet.")
+				fmt.Println()
+				continue
+			}
+			text := history[len(history)-1].Content
+			if input == "/copy code" {
+				blocks := codeBlocks(text)
+				if len(blocks) == 0 {
+					fmt.Println("The last reply has no code block.")
+					fmt.Println()
+					continue
+				}
+				text = blocks[len(blocks)-1].code
+			}
+			if err := copyToClipboard(text); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				fmt.Println()
+				continue
+			}
+			fmt.Printf("Copied %d characters.\n\n", utf8.RuneCountInString(text))
+			continue
+		case input == "/code" || strings.HasPrefix(input, "/code "):
+			if len(history) == 0 || history[len(history)-1].Role != "assistant" {
+				fmt.Println("No reply to take code from yet.")
+				fmt.Println()
+				continue
+			}
+			saveCodeBlock(history[len(history)-1].Content, strings.Fields(strings.TrimPrefix(input, "/code")))
+			fmt.Println()
+			continue
+		case strings.HasPrefix(input, "/compare "):
+			question := strings.TrimPrefix(input, "/compare ")
+			saveLastRun("compare", question, cfg)
+			runComparison(apiKey, cfg, question, stdin)
+			printBanner(cfg, openaiKey)
+			continue
+		case strings.HasPrefix(input, "/temp "):
+			question := strings.TrimPrefix(input, "/temp ")
+			saveLastRun("temp", question, cfg)
+			runTempComparison(apiKey, cfg, question, stdin)
+			printBanner(cfg, openaiKey)
+			continue
+		case strings.HasPrefix(input, "/models "):
+			question := strings.TrimPrefix(input, "/models ")
+			saveLastRun("models", question, cfg)
+			runModelComparison(apiKey, openaiKey, cfg, question, stdin)
+			printBanner(cfg, openaiKey)
+			continue
+		}
+
+		if len(vars) > 0 && !internal {
+			expanded, unknown := expandVars(input, vars)
+			for _, name := range unknown {
+				fmt.Printf("\033[2m(no variable {%s}; left as is)\033[0m\n", name)
+			}
+			if expanded != input {
+				input = expanded
+				fmt.Printf("\033[2m→ %s\033[0m\n", input)
+			}
+		}
+
+		cleared = nil
+		if !internal {
+			saveLastRun("chat", input, cfg)
+		}
+
+		// "@haiku question" asks another model for just this turn.
+		turn := cfg
+		if name, rest, ok := strings.Cut(input, " "); ok && strings.HasPrefix(name, "@") {
+			if model, ok := anthropicModel(name[1:]); ok && strings.TrimSpace(rest) != "" {
+				turn.model, input = model, strings.TrimSpace(rest)
+				_, replyLabel = turn.labels()
+				replyLabel += " [" + modelAlias(model) + "]"
+			}
+		}
+
+		history = append(history, message{Role: "user", Content: input})
+		if cfg.contextLimit > 0 {
+			n := len(history)
+			fitted := fitContext(apiKey, cfg, thread{history: history, summary: cfg.summary})
+			if history, cfg.summary = fitted.history, fitted.summary; len(history) != n {
+				window = contextUse{}
+			}
+		}
+		if cost, ok := inputCost(turn, history); ok && cfg.costWarn > 0 && cost > cfg.costWarn {
+			question := fmt.Sprintf("This request is ~%d input tokens, ~$%.4f.", estimateTokens(turn, history), cost)
+			// Piped input can't answer, so the next line isn't taken as a yes.
+			var answer string
+			var err error
+			if isTerminal(os.Stdin) {
+				answer, err = editor.readLine(question + " Send it? (y/N) ")
+			} else {
+				fmt.Printf("%s Over --cost-warn $%g, and there is no terminal to confirm on.\n", question, cfg.costWarn)
+			}
+			if err != nil || !strings.EqualFold(strings.TrimSpace(answer), "y") {
+				fmt.Println("Not sent.")
+				fmt.Println()
+				history = history[:len(history)-1]
+				continue
+			}
+		}
+
+		// Ctrl+C cancels just this reply.
+		fmt.Print("\n" + replyLabel + ": ")
+		reqCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		var res turnResult
+		history, res = chatTurn(reqCtx, apiKey, turn, history)
+		stop()
+		reply, u := res.reply, res.usage
+		switch {
+		case res.cancelled:
+			fmt.Fprintln(os.Stderr, "\n\033[2m[cancelled — turn discarded]\033[0m")
+			fmt.Println()
+			continue
+		case res.err != nil:
+			failed = res.err
+			fmt.Fprintln(os.Stderr, "\nError:", redact(res.err.Error()))
+			continue
+		}
+		failed = nil
+		if cfg.pager && reply != "" {
+			fmt.Println()
+			if err := pageText(renderReply(reply)); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+			}
+		}
+		if pretty, ok := prettyJSON(reply); ok && turn.wantsJSON() && !cfg.dryRun {
+			fmt.Print("\n\n" + pretty)
+		}
+		fmt.Print("\n\n")
+		if !cfg.pager { // the pager showed them with the reply
+			printLinkNotes(reply)
+		}
+		alert(cfg.bell, "Reply ready")
+		if reply == "" || cfg.dryRun {
+			continue // chatTurn dropped the user turn
+		}
+
+		stats.add(turn.model, u)
+		window = contextUse{tokens: u.inputTokens + u.outputTokens, msgs: len(history)}
+		if window.used(cfg, history)*2 >= contextWindow(cfg) {
+			fmt.Printf("\033[2m%s — /clear or --summarize-old frees it\033[0m\n\n", window.status(cfg, history))
+		}
+		if errs := replySchemaErrors(reply, schema); len(errs) > 0 {
+			fmt.Fprintf(os.Stderr, "The reply doesn't match %s:\n", cfg.jsonSchema)
+			for _, e := range errs {
+				fmt.Fprintln(os.Stderr, "  "+e)
+			}
+			if isTerminal(os.Stdin) {
+				answer, err := editor.readLine("Re-ask with these errors? (y/N) ")
+				fmt.Println()
+				if err == nil && strings.EqualFold(strings.TrimSpace(answer), "y") {
+					repair = repairPrompt(errs)
+					continue
+				}
+			}
+		}
+		if cfg.suggest {
+			// Ctrl+C skips the suggestions.
+			sugCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			var side usage
+			suggestions, side = suggestFollowUps(sugCtx, apiKey, turn, history)
+			stop()
+			stats.addSide(turn.model, side)
+			for i, s := range suggestions {
+				fmt.Printf("\033[2m  %d. %s\033[0m\n", i+1, s)
+			}
+			if len(suggestions) > 0 {
+				fmt.Println()
+			}
+		}
+	}
+}
+
+// turnResult is how a chat request ended.
+type turnResult struct {
+	reply     string
+	usage     usage
+	cancelled bool
+	err       error
+}
+
+// chatTurn sends history, which ends with the user's turn, and settles it:
+// a complete reply is appended. A cancelled or failed request, an empty
+// reply or a dry run drops the user turn along with any partial reply, so
+// history only ever gains complete exchanges.
+func chatTurn(ctx context.Context, apiKey string, cfg config, history []message) ([]message, turnResult) {
+	reply, u, err := streamChat(ctx, apiKey, cfg, history, nil)
+	res := turnResult{reply: reply, usage: u, cancelled: ctx.Err() != nil, err: err}
+	if res.cancelled || err != nil || reply == "" || cfg.dryRun {
+		return history[:len(history)-1], res
+	}
+	return append(history, message{Role: "assistant", Content: reply}), res
+}
+
+// suggestFollowUps asks, in a side request that stays out of the history,
+// for three follow-up questions to the latest exchange, and returns them
+// with the request's usage. Failures and cancellation give none.
+func suggestFollowUps(ctx context.Context, apiKey string, cfg config, history []message) ([]string, usage) {
+	var b strings.Builder
+	b.WriteString("Suggest 3 short follow-up questions the user might ask next in this conversation. " +
+		"Reply with the questions only, one per line, no numbering.\n\n")
+	for _, m := range history[max(len(history)-4, 0):] {
+		role := "User"
+		if m.Role == "assistant" {
+			role = "Assistant"
+		}
+		fmt.Fprintf(&b, "%s: %s\n\n", role, truncate(m.Content, 2000))
+	}
+
+	text, u, err := completeQuiet(ctx, apiKey, bareConfig(cfg, 200), []message{{Role: "user", Content: b.String()}})
+	if err != nil || ctx.Err() != nil {
+		return nil, u
+	}
+	var out []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(reListMarker.ReplaceAllString(line, ""))
+		if line != "" && len(out) < 3 {
+			out = append(out, line)
+		}
+	}
+	return out, u
+}
+
+// pipeReply re-runs the request behind the last reply, rendering it as usual
+// while streaming the raw text into the stdin of a shell command.
+func pipeReply(apiKey string, cfg config, msgs []message, command string) (string, error) {
+	cfg.pager = false // the command's output follows the reply, so stream it
+	cmd := exec.Command("sh", "-c", command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("%s: %w", command, err)
+	}
+
+	reply, _, err := streamChat(context.Background(), apiKey, cfg, msgs, stdin)
+	stdin.Close()
+	fmt.Printf("\n\n\033[2m── %s ──\033[0m\n", command)
+	if werr := cmd.Wait(); err == nil && werr != nil {
+		err = fmt.Errorf("%s: %w", command, werr)
+	}
+	return reply, err
+}
+
+// codeBlock is one fenced block from a reply.
+type codeBlock struct {
+	lang string
+	code string
+}
+
+func codeBlocks(text string) []codeBlock {
+	var blocks []codeBlock
+	for _, m := range reCodeBlock.FindAllStringSubmatch(text, -1) {
+		blocks = append(blocks, codeBlock{lang: strings.ToLower(m[1]), code: m[2]})
+	}
+	return blocks
+}
+
+// langExt maps common fence languages to file extensions.
+var langExt = map[string]string{
+	"go": ".go", "python": ".py", "py": ".py", "javascript": ".js", "js": ".js",
+	"typescript": ".ts", "ts": ".ts", "bash": ".sh", "sh": ".sh", "shell": ".sh", "zsh": ".sh",
+	"json": ".json", "yaml": ".yaml", "yml": ".yaml", "toml": ".toml", "rust": ".rs",
+	"c": ".c", "cpp": ".cpp", "c++": ".cpp", "java": ".java", "ruby": ".rb", "php": ".php",
+	"html": ".html", "css": ".css", "sql": ".sql", "markdown": ".md", "md": ".md",
+}
+
+// saveCodeBlock handles /code [n] <file>: with no file it lists the blocks,
+// otherwise it writes block n (1-based) to file, adding an extension from the
+// fence language when file has none. Without n a lone block is picked.
+func saveCodeBlock(reply string, args []string) {
+	blocks := codeBlocks(reply)
+	if len(blocks) == 0 {
+		fmt.Println("The last reply has no code block.")
+		return
+	}
+	list := func() {
+		for i, b := range blocks {
+			lang := b.lang
+			if lang == "" {
+				lang = "plain"
+			}
+			fmt.Printf("  %d. %-10s %d lines\n", i+1, lang, strings.Count(strings.TrimRight(b.code, "\n"), "\n")+1)
+		}
+	}
+
+	n, indexed := 1, len(args) == 2
+	if indexed {
+		var err error
+		if n, err = strconv.Atoi(args[0]); err != nil || n < 1 || n > len(blocks) {
+			fmt.Printf("No code block %q; the last reply has %d.\n", args[0], len(blocks))
+			return
+		}
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		fmt.Println("Usage: /code [n] <file>")
+		list()
+		return
+	}
+	if !indexed && len(blocks) > 1 {
+		fmt.Printf("The last reply has %d code blocks; pick one with /code <n> %s\n", len(blocks), args[0])
+		list()
+		return
+	}
+
+	b := blocks[n-1]
+	path := args[0]
+	if filepath.Ext(path) == "" {
+		path += langExt[b.lang]
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return
+	}
+	_, err = f.WriteString(b.code)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return
+	}
+	fmt.Printf("Wrote code block %d (%d bytes) to %s\n", n, len(b.code), path)
+}
+
+// copyToClipboard puts text on the system clipboard using the first
+// clipboard tool that works, falling back to an OSC 52 escape that most
+// terminals (including over ssh) forward to the local clipboard.
+func copyToClipboard(text string) error {
+	var tools [][]string
+	switch runtime.GOOS {
+	case "darwin":
+		tools = [][]string{{"pbcopy"}}
+	case "windows":
+		tools = [][]string{{"clip"}}
+	default:
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			tools = append(tools, []string{"wl-copy"})
+		}
+		tools = append(tools, []string{"xclip", "-selection", "clipboard"}, []string{"xsel", "--clipboard", "--input"})
+	}
+	for _, t := range tools {
+		if _, err := exec.LookPath(t[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(t[0], t[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		if cmd.Run() == nil {
+			return nil
+		}
+	}
+	if !isTerminal(os.Stdout) {
+		return errors.New("no clipboard tool found (pbcopy, wl-copy, xclip or xsel)")
+	}
+	fmt.Printf("\033]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(text)))
+	return nil
+}
+
+// renderReply renders a whole reply the way streaming would, with link
+// footnotes appended, for showing it in one piece.
+func renderReply(text string) string {
+	if renderOpts.compact {
+		var b blankSqueezer
+		text = b.squeeze(text)
+	}
+	var refs linkRefs
+	text = strings.TrimRight(renderMarkdown(text, &refs), "\n")
+	if notes := refs.notes(); notes != "" {
+		text += "\n\n" + notes
+	}
+	return text + "\n"
+}
+
+// pageText shows text through $PAGER, or less -FRX, which prints text that
+// fits on one screen inline and keeps the colors. Without a terminal the
+// text is just printed.
+func pageText(text string) error {
+	if !isTerminal(os.Stdout) {
+		fmt.Print(text)
+		return nil
+	}
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less"
+		if _, err := exec.LookPath(pager); err != nil {
+			pager = "more"
+		}
+	}
+	cmd := exec.Command("sh", "-c", pager)
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", pager)
+	}
+	cmd.Env = os.Environ()
+	if os.Getenv("LESS") == "" {
+		cmd.Env = append(cmd.Env, "LESS=FRX")
+	}
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pager %s: %w", pager, err)
+	}
+	return nil
+}
+
+// printTail shows the last n messages, one line each.
+func printTail(history []message, n int, cfg config) {
+	user, reply := cfg.labels()
+	start := max(len(history)-n, 0)
+	for _, m := range history[start:] {
+		label := user
+		if m.Role == "assistant" {
+			label = reply
+		}
+		fmt.Printf("  \033[2m%s: %s\033[0m\n", label, truncate(strings.Join(strings.Fields(m.Content), " "), 100))
+	}
+}
+
+// alert signals that a long-running reply finished. It is a no-op unless
+// stdout is a terminal.
+func alert(mode, msg string) {
+	if mode == "" || !isTerminal(os.Stdout) {
+		return
+	}
+	switch mode {
+	case "beep":
+		fmt.Print("\a")
+	case "flash":
+		fmt.Print("\033[?5h")
+		time.Sleep(150 * time.Millisecond)
+		fmt.Print("\033[?5l")
+	case "notify":
+		var cmd *exec.Cmd
+		if runtime.GOOS == "darwin" {
+			cmd = exec.Command("osascript", "-e", fmt.Sprintf("display notification %q with title \"challenge\"", msg))
+		} else {
+			cmd = exec.Command("notify-send", "challenge", msg)
+		}
+		if cmd.Start() == nil {
+			go cmd.Wait()
+		}
+	}
+}
+
+// ─── Context window ───────────────────────────────────────────────────────────
+
+// estimateTokens approximates the prompt size with the ~4 chars per token rule.
+func estimateTokens(cfg config, msgs []message) int {
+	n := utf8.RuneCountInString(buildSystemPrompt(cfg))
+	for _, m := range msgs {
+		n += utf8.RuneCountInString(m.Content)
+	}
+	return n / 4
+}
+
+// inputCost estimates what sending msgs costs in input tokens alone; ok is
+// false for models without a known price.
+func inputCost(cfg config, msgs []message) (float64, bool) {
+	costIn, _, ok := catalogPrice(cfg.model)
+	if !ok {
+		return 0, false
+	}
+	return float64(estimateTokens(cfg, msgs)) * costIn / 1e6, true
+}
+
+// countTokens asks the token-counting endpoint how many input tokens msgs
+// and cfg's system prompt come to.
+func countTokens(apiKey string, cfg config, msgs []message) (int, error) {
+	if cfg.mock || cfg.dryRun {
+		return 0, errors.New("offline mode")
+	}
+	params := map[string]any{"model": cfg.model, "messages": msgs}
+	if sys := buildSystemPrompt(cfg); sys != "" {
+		params["system"] = sys
+	}
+	body, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", anthropicMessagesURL(cfg)+"/count_tokens", bytes.NewReader(body))
+	setAnthropicHeaders(req, apiKey, cfg)
+
+	resp, err := cfg.httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err := decodeBody(resp); err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != 200 {
+		errBody, _ := io.ReadAll(resp.Body)
+		return 0, &apiError{resp.StatusCode, string(errBody), "ANTHROPIC_API_KEY"}
+	}
+	var out struct {
+		InputTokens int `json:"input_tokens"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, fmt.Errorf("count_tokens response: %w", err)
+	}
+	return out.InputTokens, nil
+}
+
+// tokenReport counts msgs with the API, falling back to the chars/4
+// estimate, labelled approximate, when the endpoint can't be used.
+func tokenReport(apiKey string, cfg config, msgs []message) string {
+	n, err := countTokens(apiKey, cfg, msgs)
+	if err != nil {
+		return fmt.Sprintf("~%d tokens (approximate; token counting unavailable: %s)",
+			estimateTokens(cfg, msgs), truncate(redact(err.Error()), 80))
+	}
+	return fmt.Sprintf("%d tokens", n)
+}
+
+// contextUse tracks how much of the context window the history fills. It is
+// anchored on the token counts the API reported for the last turn; messages
+// added since then are estimated.
+type contextUse struct {
+	tokens int // input + output tokens of the last turn
+	msgs   int // history length those tokens cover; 0 = no turn yet
+}
+
+// used returns the tokens history would take up in the next request.
+func (c contextUse) used(cfg config, history []message) int {
+	if c.msgs == 0 || c.msgs > len(history) {
+		return estimateTokens(cfg, history)
+	}
+	n := 0
+	for _, m := range history[c.msgs:] {
+		n += utf8.RuneCountInString(m.Content)
+	}
+	return c.tokens + n/4
+}
+
+// status formats the usage, e.g. "context: 3.2K / 200K (2%)". A leading ~
+// marks a pure estimate, made before the API has reported any usage.
+func (c contextUse) status(cfg config, history []message) string {
+	n, window := c.used(cfg, history), contextWindow(cfg)
+	approx := ""
+	if c.msgs == 0 || c.msgs > len(history) {
+		approx = "~"
+	}
+	s := fmt.Sprintf("context: %s%s / %s (%d%%)", approx, formatTokens(n), formatTokens(window), n*100/window)
+	if cfg.contextLimit > 0 {
+		s += fmt.Sprintf(", trimmed above ~%s", formatTokens(cfg.contextLimit))
+	}
+	return s
+}
+
+// contextWindow is the model's context size in tokens: 200K for current
+// Claude models, or 1M with a context-1m beta.
+func contextWindow(cfg config) int {
+	for _, b := range cfg.betas {
+		if strings.HasPrefix(b, "context-1m") {
+			return 1_000_000
+		}
+	}
+	return 200_000
+}
+
+// formatTokens abbreviates a token count: 950, 3.2K, 200K, 1M.
+func formatTokens(n int) string {
+	switch {
+	case n >= 1_000_000:
+		return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(n)/1e6), ".0") + "M"
+	case n >= 1000:
+		return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(n)/1e3), ".0") + "K"
+	}
+	return strconv.Itoa(n)
+}
+
+// fitContext drops the oldest exchanges until t's history fits
+// cfg.contextLimit, always keeping the latest user message. With
+// cfg.summarizeOld the dropped turns are folded into t's summary, so the
+// summary stays with the history it came from.
+func fitContext(apiKey string, cfg config, t thread) thread {
+	history := t.history
+	before := estimateTokens(cfg, history)
+	if before <= cfg.contextLimit {
+		return t
+	}
+
+	cut := 0
+	for cut < len(history)-1 && estimateTokens(cfg, history[cut:]) > cfg.contextLimit {
+		cut += 2 // one user + assistant exchange
+	}
+	if cut > len(history)-1 {
+		cut = len(history) - 1
+	}
+	if cut == 0 {
+		return t
+	}
+	dropped, kept := history[:cut], history[cut:]
+
+	if cfg.summarizeOld {
+		summary, err := summarize(apiKey, cfg, t.summary, dropped)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "(context: summary failed, dropping instead:", redact(err.Error())+")")
+		} else {
+			t.summary = summary
+		}
+	}
+
+	after := estimateTokens(cfg, kept)
+	fmt.Fprintf(os.Stderr, "\033[2m(context: trimmed %d old messages, ~%d → ~%d tokens)\033[0m\n", len(dropped), before, after)
+	t.history = kept
+	return t
+}
+
+// summarize asks the model to compress msgs (plus any earlier summary) into
+// a short note.
+func summarize(apiKey string, cfg config, earlier string, msgs []message) (string, error) {
+	var b strings.Builder
+	b.WriteString("Summarize this conversation into a concise note for your own future reference. " +
+		"Keep facts, decisions, names and open questions. Reply with the note only.\n\n")
+	if earlier != "" {
+		b.WriteString("Earlier summary:\n" + earlier + "\n\n")
+	}
+	for _, m := range msgs {
+		role := "User"
+		if m.Role == "assistant" {
+			role = "Assistant"
+		}
+		fmt.Fprintf(&b, "%s: %s\n\n", role, m.Content)
+	}
+
+	text, _, err := completeQuiet(context.Background(), apiKey, bareConfig(cfg, 1024), []message{{Role: "user", Content: b.String()}})
+	return text, err
+}
+
+// bareConfig keeps cfg's model and transport settings but drops the system
+// prompt and sampling settings, for side requests like summaries.
+func bareConfig(cfg config, maxTokens int) config {
+	cfg.system, cfg.systemText, cfg.format, cfg.stop, cfg.summary = "", "", "", "", ""
+	cfg.maxTokens = maxTokens
+	cfg.temperature = -1
+	return cfg
+}
+
+// ─── Line editor ──────────────────────────────────────────────────────────────
+
+const editorHistoryMax = 500 // default --history-size
+
+// defaultHistoryFile is CHALLENGE_HISTORY when set, even to "" (which, like
+// an empty HISTFILE, turns saving off), else ~/.challenge_history.
+func defaultHistoryFile() string {
+	if path, ok := os.LookupEnv("CHALLENGE_HISTORY"); ok {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return home + "/.challenge_history"
+}
+
+// chatCommands is the Tab-completion list; a trailing space marks commands
+// that take an argument.
+var chatCommands = []string{
+	"/help", "/clear", "/clear!", "/undo-clear", "/system ", "/system+ ", "/system-", "/system-file ", "/prompt", "/preset ",
+	"/branch ", "/branches", "/switch ", "/pipe ", "/ctx", "/compact", "/tokens", "/spend", "/set ", "/unset ", "/vars", "/again", "/last", "/use ", "/raw", "/copy", "/copy code", "/code ",
+	"/compare ", "/temp ", "/models ", "exit", "quit",
+}
+
+// pathCommands complete their argument against the file system.
+var pathCommands = map[string]bool{"/system-file": true}
+
+// lineEditor reads the chat prompt. On a terminal it reads keys in raw mode
+// (history, cursor movement, Ctrl+R reverse search); otherwise it reads
+// plain lines.
+type lineEditor struct {
+	in          *bufio.Reader
+	raw         bool
+	history     []string // entered lines, oldest first
+	historyFile string   // "" saves nothing
+	historySize int      // lines kept in memory and in the file
+	fileLines   int      // lines in historyFile, to know when to trim it
+}
+
+// newLineEditor loads up to size lines of history from file. With an empty
+// file or a size of 0 the history lives only for the session.
+func newLineEditor(file string, size int) *lineEditor {
+	e := &lineEditor{
+		in:          stdin,
+		raw:         isTerminal(os.Stdin) && isTerminal(os.Stdout),
+		historySize: max(size, 0),
+	}
+	if file != "" && size > 0 {
+		e.historyFile = file
+		e.loadHistory()
+	}
+	return e
+}
+
+func (e *lineEditor) loadHistory() {
+	data, err := os.ReadFile(e.historyFile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+	e.fileLines = len(e.history)
+	if len(e.history) > e.historySize {
+		e.history = e.history[len(e.history)-e.historySize:]
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// sttyMode applies stty settings to the terminal and returns a func that
+// restores the previous state.
+func sttyMode(args ...string) (restore func(), err error) {
+	get := exec.Command("stty", "-g")
+	get.Stdin = os.Stdin
+	saved, err := get.Output()
+	if err != nil {
+		return nil, err
+	}
+	set := exec.Command("stty", args...)
+	set.Stdin = os.Stdin
+	if err := set.Run(); err != nil {
+		return nil, err
+	}
+	return func() {
+		reset := exec.Command("stty", strings.TrimSpace(string(saved)))
+		reset.Stdin = os.Stdin
+		reset.Run()
+	}, nil
+}
+
+// watchStdin calls onKey for every byte typed on the terminal until stop is
+// called. Echo and line buffering are off meanwhile; Ctrl+C still signals.
+func watchStdin(onKey func(b byte)) (stop func()) {
+	if !isTerminal(os.Stdin) {
+		return func() {}
+	}
+	// Reads return every 100ms so the watcher notices when to stop.
+	restore, err := sttyMode("-icanon", "-echo", "min", "0", "time", "1")
+	if err != nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		buf := make([]byte, 16)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			n, _ := os.Stdin.Read(buf)
+			for _, b := range buf[:n] {
+				onKey(b)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		restore()
+	}
+}
+
+// stdin is the one buffered reader over os.Stdin that the line editor,
+// the comparison screens and the pager share, so none of them loses input
+// another has buffered.
+var stdin = bufio.NewReader(typeAhead)
+
+// readLine reads a line from r without its line ending. A last line with
+// no newline still counts; after it comes io.EOF.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if line == "" && err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// typeAhead is os.Stdin with the keys typed while a chat reply streamed
+// (see streamChat) put back in front, so they reach the next prompt.
+var typeAhead = &keyBuffer{}
+
+type keyBuffer struct {
+	mu   sync.Mutex
+	keys []byte
+}
+
+func (k *keyBuffer) push(b byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = append(k.keys, b)
+}
+
+func (k *keyBuffer) Read(p []byte) (int, error) {
+	k.mu.Lock()
+	if len(k.keys) > 0 {
+		defer k.mu.Unlock()
+		n := copy(p, k.keys)
+		k.keys = k.keys[n:]
+		return n, nil
+	}
+	k.mu.Unlock()
+	return os.Stdin.Read(p)
+}
+
+func (e *lineEditor) add(line string) {
+	if n := len(e.history); n > 0 && e.history[n-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > e.historySize && e.historySize > 0 {
+		e.history = e.history[len(e.history)-e.historySize:]
+	}
+	if e.historyFile == "" {
+		return
+	}
+	e.fileLines++
+	if e.fileLines > e.historySize {
+		// Rewrite the file with just the newest lines.
+		if os.WriteFile(e.historyFile, []byte(strings.Join(e.history, "\n")+"\n"), 0600) == nil {
+			e.fileLines = len(e.history)
+		}
+		return
+	}
+	f, err := os.OpenFile(e.historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+// readLine shows prompt and returns the entered line. Ctrl+C and Ctrl+D on
+// an empty line return io.EOF.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	if !e.raw {
+		fmt.Print(prompt)
+		return readLine(e.in)
+	}
+
+	restore, err := sttyMode("raw", "-echo")
+	if err != nil {
+		e.raw = false
+		return e.readLine(prompt)
+	}
+	defer restore()
+
+	var buf []rune
+	pos := 0               // cursor position in buf
+	hist := len(e.history) // history entry being shown; len(history) is the draft
+	var draft []rune
+	showHistory := func(i int) {
+		if hist == len(e.history) {
+			draft = buf
+		}
+		hist = i
+		if i == len(e.history) {
+			buf = draft
+		} else {
+			buf = []rune(e.history[i])
+		}
+		pos = len(buf)
+	}
+
+	fmt.Print(prompt)
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Print("\r\n")
+			return string(buf), nil
+		case 3, 4: // Ctrl+C, Ctrl+D
+			if r == 4 && len(buf) > 0 {
+				continue
+			}
+			fmt.Print("\r\n")
+			return "", io.EOF
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1:pos-1], buf[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl+A
+			pos = 0
+		case 5: // Ctrl+E
+			pos = len(buf)
+		case 21: // Ctrl+U
+			buf, pos = buf[pos:], 0
+		case 18: // Ctrl+R
+			buf = e.reverseSearch(buf)
+			pos = len(buf)
+		case '\t':
+			buf = e.complete(prompt, buf)
+			pos = len(buf)
+		case 27:
+			switch readEscape(e.in) {
+			case "[A", "OA": // Up
+				if hist > 0 {
+					showHistory(hist - 1)
+				}
+			case "[B", "OB": // Down
+				if hist < len(e.history) {
+					showHistory(hist + 1)
+				}
+			case "[C", "OC": // Right
+				if pos < len(buf) {
+					pos++
+				}
+			case "[D", "OD": // Left
+				if pos > 0 {
+					pos--
+				}
+			case "[H", "OH", "[1~":
+				pos = 0
+			case "[F", "OF", "[4~":
+				pos = len(buf)
+			case "[3~": // Delete
+				if pos < len(buf) {
+					buf = append(buf[:pos:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if r >= ' ' {
+				buf = append(buf[:pos:pos], append([]rune{r}, buf[pos:]...)...)
+				pos++
+			}
+		}
+		fmt.Printf("\r\033[K%s%s", prompt, string(buf))
+		if n := len(buf) - pos; n > 0 {
+			fmt.Printf("\033[%dD", n)
+		}
+	}
+}
+
+// complete handles Tab: slash commands, then file paths for pathCommands.
+// Ambiguous matches are extended to their common prefix and listed.
+func (e *lineEditor) complete(prompt string, buf []rune) []rune {
+	line := string(buf)
+	var head, word string
+	var candidates []string
+
+	if cmd, arg, ok := strings.Cut(line, " "); ok && pathCommands[cmd] {
+		head, word = cmd+" ", arg
+		candidates = completePath(arg)
+	} else if !ok {
+		word = line
+		for _, c := range chatCommands {
+			if strings.HasPrefix(c, line) {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return buf
+	case 1:
+		return []rune(head + candidates[0])
+	}
+
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			_, size := utf8.DecodeLastRuneInString(prefix) // whole runes, so "фа" and "фо" share "ф"
+			prefix = prefix[:len(prefix)-size]
+		}
+	}
+	if len(prefix) > len(word) {
+		return []rune(head + prefix)
+	}
+	names := make([]string, len(candidates))
+	for i, c := range candidates {
+		names[i] = strings.TrimSpace(c)
+		if head != "" {
+			names[i] = filepath.Base(c)
+			if strings.HasSuffix(c, "/") {
+				names[i] += "/"
+			}
+		}
+	}
+	fmt.Printf("\r\n%s\r\n%s", strings.Join(names, "  "), prompt)
+	return buf
+}
+
+// completePath lists paths starting with partial; directories end in "/".
+func completePath(partial string) []string {
+	dir, base := filepath.Split(partial)
+	entries, err := os.ReadDir(filepath.Join(".", dir))
+	if err != nil {
+		return nil
+	}
+	var out []string
+	for _, ent := range entries {
+		name := ent.Name()
+		if !strings.HasPrefix(name, base) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		if ent.IsDir() {
+			name += "/"
+		}
+		out = append(out, dir+name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// readEscape reads the rest of an escape sequence (arrow keys etc.) and
+// returns it without the leading ESC, or "" for a lone Escape.
+func readEscape(in *bufio.Reader) string {
+	if in.Buffered() == 0 {
+		return ""
+	}
+	b, _ := in.ReadByte()
+	seq := []byte{b}
+	if b != '[' && b != 'O' {
+		return string(seq)
+	}
+	for in.Buffered() > 0 {
+		b, _ := in.ReadByte()
+		seq = append(seq, b)
+		if b >= 0x40 && b <= 0x7e {
+			break
+		}
+	}
+	return string(seq)
+}
+
+// reverseSearch runs an incremental Ctrl+R search over the history and
+// returns the line to prefill the prompt with.
+func (e *lineEditor) reverseSearch(orig []rune) []rune {
+	var query []rune
+	at := -1 // index of the current match
+	find := func(from int) {
+		for i := from; i >= 0; i-- {
+			if strings.Contains(e.history[i], string(query)) {
+				at = i
+				return
+			}
+		}
+	}
+
+	for {
+		match := ""
+		if at >= 0 {
+			match = e.history[at]
+		}
+		fmt.Printf("\r\033[K(reverse-i-search)`%s': %s", string(query), match)
+
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return orig
+		}
+		switch r {
+		case 18: // Ctrl+R again: next older match
+			if at > 0 {
+				find(at - 1)
+			}
+		case 127, 8:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+				at = -1
+				find(len(e.history) - 1)
+			}
+		case 3, 7: // Ctrl+C, Ctrl+G: abort
+			return orig
+		case '\r', '\n', 27:
+			if r == 27 {
+				readEscape(e.in)
+			}
+			if at < 0 {
+				return orig
+			}
+			return []rune(match)
+		default:
+			if r >= ' ' {
+				query = append(query, r)
+				if at < 0 {
+					at = len(e.history) - 1
+				}
+				start := at
+				at = -1
+				find(start)
+			}
+		}
+	}
+}
+
+// ─── API ──────────────────────────────────────────────────────────────────────
+
+// anthropicRequest is the body of a streaming Messages API request. Fields
+// are in JSON key order, so the output matches a marshalled map.
+type anthropicRequest struct {
+	MaxTokens     int       `json:"max_tokens"`
+	Messages      []message `json:"messages"`
+	Model         string    `json:"model"`
+	StopSequences []string  `json:"stop_sequences,omitempty"`
+	Stream        bool      `json:"stream"`
+	System        string    `json:"system,omitempty"`
+	Temperature   *float64  `json:"temperature,omitempty"` // nil = API default
+
+	Extra map[string]any `json:"-"` // --extra-json, merged over the fields above
+}
+
+// MarshalJSON merges Extra over the typed fields; last writer wins.
+func (r anthropicRequest) MarshalJSON() ([]byte, error) {
+	type plain anthropicRequest // drops the method, avoiding recursion
+	b, err := json.Marshal(plain(r))
+	if err != nil || len(r.Extra) == 0 {
+		return b, err
+	}
+	var merged map[string]json.RawMessage
+	if err := json.Unmarshal(b, &merged); err != nil {
+		return nil, err
+	}
+	for k, v := range r.Extra {
+		if merged[k], err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(merged)
+}
+
+func buildRequest(cfg config, msgs []message) anthropicRequest {
+	req := anthropicRequest{
+		Model:     cfg.model,
+		MaxTokens: cfg.maxTokens,
+		Messages:  msgs,
+		Stream:    true,
+		System:    buildSystemPrompt(cfg),
+	}
+
+	if cfg.temperature >= 0 {
+		req.Temperature = &cfg.temperature
+	}
+	if cfg.stop != "" {
+		req.StopSequences = []string{cfg.stop}
+	}
+
+	req.Extra, _ = parseExtraJSON(cfg.extraJSON) // validated in parseArgs
+	return req
+}
+
+// managedParams are the request fields buildRequest sets from flags;
+// --extra-json may override them, with a warning.
+var managedParams = []string{"model", "max_tokens", "messages", "stream", "temperature", "system", "stop_sequences"}
+
+// parseExtraJSON decodes --extra-json, which must be a JSON object.
+func parseExtraJSON(s string) (map[string]any, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var extra map[string]any
+	if err := json.Unmarshal([]byte(s), &extra); err != nil || extra == nil {
+		return nil, fmt.Errorf("--extra-json must be a JSON object, got %q", s)
+	}
+	return extra, nil
+}
+
+// buildOpenAIRequest builds a Chat Completions request. OpenAI has no
+// top-level system field, so the system prompt from buildSystemPrompt (with
+// --format and --stop folded in) goes first as a "system" message.
+func buildOpenAIRequest(model string, cfg config, msgs []message) map[string]any {
+	openaiMsgs := make([]map[string]string, 0, len(msgs)+1)
+	if sp := buildSystemPrompt(cfg); sp != "" {
+		openaiMsgs = append(openaiMsgs, map[string]string{"role": "system", "content": sp})
+	}
+	for _, m := range msgs {
+		openaiMsgs = append(openaiMsgs, map[string]string{"role": m.Role, "content": m.Content})
+	}
+
+	req := map[string]any{
+		"model":          model,
+		"messages":       openaiMsgs,
+		"stream":         true,
+		"stream_options": map[string]any{"include_usage": true},
+	}
+
+	// Reasoning models take max_completion_tokens and reject max_tokens and
+	// any temperature but the default.
+	if isReasoningModel(model) {
+		req["max_completion_tokens"] = cfg.maxTokens
+	} else {
+		req["max_tokens"] = cfg.maxTokens
+		if cfg.temperature >= 0 {
+			req["temperature"] = cfg.temperature
+		}
+	}
+	if cfg.stop != "" {
+		req["stop"] = []string{cfg.stop}
+	}
+
+	return req
+}
+
+// isReasoningModel reports whether an OpenAI model is one of the o-series or
+// GPT-5 reasoning models.
+func isReasoningModel(model string) bool {
+	for _, prefix := range []string{"o1", "o3", "o4", "gpt-5"} {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildGeminiRequest builds a generateContent body. Gemini calls the
+// assistant role "model" and takes the system prompt separately.
+func buildGeminiRequest(cfg config, msgs []message) map[string]any {
+	contents := make([]map[string]any, 0, len(msgs))
+	for _, m := range msgs {
+		role := m.Role
+		if role == "assistant" {
+			role = "model"
+		}
+		contents = append(contents, map[string]any{
+			"role":  role,
+			"parts": []map[string]string{{"text": m.Content}},
+		})
+	}
+
+	gen := map[string]any{"maxOutputTokens": cfg.maxTokens}
+	if cfg.temperature >= 0 {
+		gen["temperature"] = cfg.temperature
+	}
+	if cfg.stop != "" {
+		gen["stopSequences"] = []string{cfg.stop}
+	}
+
+	req := map[string]any{"contents": contents, "generationConfig": gen}
+	if sp := buildSystemPrompt(cfg); sp != "" {
+		req["systemInstruction"] = map[string]any{"parts": []map[string]string{{"text": sp}}}
+	}
+	return req
+}
+
+// isSecretHeader reports whether the header carries an API key: one of the
+// providers' own, or an authHeader from the catalog.
+func isSecretHeader(name string) bool {
+	switch strings.ToLower(name) {
+	case "x-api-key", "authorization", "api-key", "x-goog-api-key":
+		return true
+	}
+	for _, entry := range providerCatalog {
+		if entry.authHeader != "" && strings.EqualFold(name, entry.authHeader) {
+			return true
+		}
+	}
+	return false
+}
+
+func maskKey(key string) string {
+	if len(key) <= 8 {
+		return "****"
+	}
+	return key[:8] + "****"
+}
+
+// formatCurl renders the request as a runnable curl command with the key masked.
+func formatCurl(apiKey string, cfg config, body []byte) string {
+	var pretty bytes.Buffer
+	json.Indent(&pretty, body, "  ", "  ")
+	var b strings.Builder
+	fmt.Fprintf(&b, "curl -X POST %s \\\n", anthropicMessagesURL(cfg))
+	fmt.Fprintf(&b, "  -H \"x-api-key: %s\" \\\n", maskKey(apiKey))
+	fmt.Fprintf(&b, "  -H \"anthropic-version: %s\" \\\n", cfg.apiVersion)
+	if len(cfg.betas) > 0 {
+		fmt.Fprintf(&b, "  -H \"anthropic-beta: %s\" \\\n", cfg.betas.String())
+	}
+	fmt.Fprintf(&b, "  -H \"content-type: application/json\" \\\n")
+	fmt.Fprintf(&b, "  -d '%s'\n", pretty.String())
+	return b.String()
+}
+
+// printCurl echoes the curl equivalent and the exact request JSON to stderr.
+func printCurl(apiKey string, cfg config, body []byte) {
+	fmt.Fprintf(os.Stderr, "\n\033[2m── curl ────────────────────────────────────────────────────\033[0m\n")
+	fmt.Fprintf(os.Stderr, "\033[2m%s\033[0m", redact(formatCurl(apiKey, cfg, body)))
+	fmt.Fprintf(os.Stderr, "\033[2m── request JSON ────────────────────────────────────────────\033[0m\n")
+	fmt.Fprintf(os.Stderr, "\033[2m%s\033[0m\n", redact(string(body)))
+	fmt.Fprintf(os.Stderr, "\033[2m────────────────────────────────────────────────────────────\033[0m\n\n")
+}
+
+// maxResumes bounds how often streamChat re-requests after a dropped stream.
+const maxResumes = 2
+
+// errStreamCut reports a stream that ended before message_stop.
+var errStreamCut = errors.New("stream ended before message_stop")
+
+// streamChat streams a reply to stdout. If the connection drops mid-reply it
+// re-requests with the partial text prefilled as the assistant turn and
+// stitches the continuation on; a cancelled ctx stops it for good. The raw
+// reply text is also copied to tee when it is non-nil. The usage is that of
+// the last request.
+func streamChat(ctx context.Context, apiKey string, cfg config, msgs []message, tee io.Writer) (string, usage, error) {
+	var reply string
+	var u usage
+	var gate *pauseGate
+	if !cfg.pager && isTerminal(os.Stdin) && isTerminal(os.Stdout) {
+		gate = &pauseGate{}
+		stop := watchStdin(func(b byte) {
+			if b == ' ' {
+				gate.toggle()
+			} else {
+				typeAhead.push(b)
+			}
+		})
+		defer func() {
+			gate.wait(ctx) // a reply that finished while paused shows on resume
+			stop()
+		}()
+	}
+	// One printer across resumes, so a continuation carries on its line
+	// and its link numbering.
+	sp := &streamPrinter{gate: gate, words: cfg.flush == "words", done: ctx.Done()}
+	if isTerminal(os.Stdout) {
+		sp.delay = time.Duration(cfg.typingDelay) * time.Millisecond
+	}
+	for attempt := 0; ; attempt++ {
+		convo := msgs
+		if reply != "" {
+			reply = strings.TrimRight(reply, " \t\r\n") // the API rejects trailing whitespace in a prefill
+			convo = append(slices.Clone(msgs), message{Role: "assistant", Content: reply})
+		}
+
+		resp, err := sendMessages(ctx, apiKey, cfg, convo)
+		if err != nil {
+			return reply, u, err
+		}
+		var text string
+		if isWholeMessage(cfg, resp) {
+			text, u, err = readMessage(resp.Body, cfg, tee, sp)
+		} else {
+			text, u, err = readStream(resp.Body, cfg, tee, sp)
+		}
+		resp.Body.Close()
+		reply += text
+
+		if err == nil || reply == "" || attempt == maxResumes || ctx.Err() != nil {
+			return reply, u, err
+		}
+		fmt.Fprintf(os.Stderr, "\033[2m[connection lost: %s — resuming]\033[0m", redact(err.Error()))
+	}
+}
+
+// completeQuiet runs a request without printing and returns the reply text
+// and usage. The usage also goes to the spend log.
+func completeQuiet(ctx context.Context, apiKey string, cfg config, msgs []message) (string, usage, error) {
+	resp, err := sendMessages(ctx, apiKey, cfg, msgs)
+	if err != nil {
+		return "", usage{}, err
+	}
+	defer resp.Body.Close()
+
+	if isWholeMessage(cfg, resp) {
+		text, u, err := decodeMessage(resp.Body)
+		cfg.ledger.add(cfg.model, u)
+		return strings.TrimSpace(text), u, err
+	}
+	var full strings.Builder
+	var u usage
+	err = parseAnthropicStream(resp.Body, func(text string) { full.WriteString(text) }, func(last usage) { u = last }, nil, nil)
+	cfg.ledger.add(cfg.model, u)
+	return strings.TrimSpace(full.String()), u, err
+}
+
+// anthropicMessagesURL is the Messages endpoint under --anthropic-base-url
+// (or ANTHROPIC_BASE_URL). The base may end in /v1 or not.
+func anthropicMessagesURL(cfg config) string {
+	base := strings.TrimSuffix(strings.TrimRight(cfg.anthropicURL, "/"), "/v1")
+	if base == "" {
+		base = "https://api.anthropic.com"
+	}
+	return base + "/v1/messages"
+}
+
+// sendMessages posts a Messages request, streaming unless --no-stream, and
+// returns the response once the status is known to be OK. The caller closes
+// the body.
+func sendMessages(ctx context.Context, apiKey string, cfg config, msgs []message) (*http.Response, error) {
+	r := buildRequest(cfg, msgs)
+	r.Stream = !cfg.noStream
+	body, _ := json.Marshal(r)
+
+	if cfg.verbose {
+		printCurl(apiKey, cfg, body)
+	}
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", anthropicMessagesURL(cfg), bytes.NewReader(body))
+	setAnthropicHeaders(req, apiKey, cfg)
+
+	resp, err := cfg.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeBody(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		errBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, &apiError{resp.StatusCode, string(errBody), "ANTHROPIC_API_KEY"}
+	}
+	return resp, nil
+}
+
+// setAnthropicHeaders sets auth, version, beta and encoding headers for a
+// Messages API request.
+func setAnthropicHeaders(req *http.Request, apiKey string, cfg config) {
+	req.Header.Set("x-api-key", apiKey)
+	req.Header.Set("anthropic-version", cfg.apiVersion)
+	if len(cfg.betas) > 0 {
+		req.Header.Set("anthropic-beta", cfg.betas.String())
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+}
+
+// decodeBody swaps resp.Body for a decompressing reader when the server
+// compressed the response. Setting Accept-Encoding by hand turns off
+// net/http's transparent gunzip, so every request that sets it must call this.
+// Closing the new body closes the original one.
+func decodeBody(resp *http.Response) error {
+	var r io.Reader
+	var err error
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip":
+		r, err = gzip.NewReader(resp.Body)
+	case "deflate":
+		r, err = zlib.NewReader(resp.Body)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{r, resp.Body}
+	return nil
+}
+
+// maxSSELine bounds a single SSE line; bufio.Scanner's 64KB default is too small.
+const maxSSELine = 4 << 20
+
+// readSSE calls fn with the payload of each SSE event, joining multi-line
+// data fields with "\n". fn returns false to stop reading. onPing, if set, is
+// called for heartbeats: comment lines (": keep-alive") and ping events.
+func readSSE(r io.Reader, fn func(data string) bool, onPing func()) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxSSELine)
+
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(data) > 0 {
+				payload := strings.Join(data, "\n")
+				data = data[:0]
+				if !fn(payload) {
+					return nil
+				}
+			}
+			continue
+		}
+		if onPing != nil && (strings.HasPrefix(line, ":") || line == "event: ping") {
+			onPing()
+		}
+		if v, ok := strings.CutPrefix(line, "data:"); ok {
+			data = append(data, strings.TrimPrefix(v, " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		fn(strings.Join(data, "\n"))
+	}
+	return nil
+}
+
+// splitUTF8 returns s up to the last complete rune, and the trailing bytes of
+// a multibyte sequence that the next chunk is expected to finish.
+func splitUTF8(s string) (complete, tail string) {
+	for i := len(s) - 1; i >= 0 && i >= len(s)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(s[i]) {
+			if !utf8.FullRuneInString(s[i:]) {
+				return s[:i], s[i:]
+			}
+			break
+		}
+	}
+	return s, ""
+}
+
+// readStream prints tokens as they arrive, rendering markdown line-by-line.
+// The raw text is collected for the return value and copied to tee, if set.
+// With --pager nothing is printed; the caller pages the whole reply.
+func readStream(r io.Reader, cfg config, tee io.Writer, sp *streamPrinter) (string, usage, error) {
+	var full strings.Builder
+	var raw io.Writer = &full
+	if tee != nil {
+		raw = io.MultiWriter(&full, tee)
+	}
+	var carry string
+	var u usage
+	gate := sp.gate
+
+	// Heartbeats before the first token show that the connection is alive;
+	// the note is erased once text arrives.
+	const aliveNote = "(alive, waiting for tokens…)"
+	alive := false
+	unalive := func() {
+		if alive {
+			gate.print(fmt.Sprintf("\033[%dD\033[K", utf8.RuneCountInString(aliveNote)))
+			alive = false
+		}
+	}
+
+	err := parseAnthropicStream(r,
+		func(delta string) {
+			unalive()
+			var text string
+			text, carry = splitUTF8(carry + delta)
+			io.WriteString(raw, text)
+			if !cfg.pager {
+				sp.write(text)
+			}
+		},
+		func(latest usage) { u = latest },
+		nil,
+		func() {
+			if !alive && full.Len() == 0 && isTerminal(os.Stdout) {
+				gate.print("\033[2m" + aliveNote + "\033[0m")
+				alive = true
+			}
+		})
+	unalive()
+
+	io.WriteString(raw, carry)
+	if !cfg.pager {
+		sp.write(carry)
+		sp.flush()
+	}
+
+	if note := droppedNote(cfg, u.dropped); note != "" {
+		fmt.Fprintf(os.Stderr, "\n\033[2m%s\033[0m", note)
+	}
+	if err == nil && full.Len() == 0 {
+		printEmpty(u)
+	}
+	return full.String(), u, err
+}
+
+// printEmpty notes a reply that came back without any text.
+func printEmpty(u usage) {
+	stopReason := u.stopReason
+	if stopReason == "" {
+		stopReason = "unknown"
+	}
+	fmt.Printf("\033[2m(empty response — stop_reason: %s)\033[0m", stopReason)
+}
+
+// isWholeMessage reports whether resp carries a complete Messages response
+// (--no-stream) rather than an SSE stream. Offline modes always stream.
+func isWholeMessage(cfg config, resp *http.Response) bool {
+	return cfg.noStream && !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+}
+
+// decodeMessage parses a non-streaming Messages response into its text and
+// usage.
+func decodeMessage(r io.Reader) (string, usage, error) {
+	var msg struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		StopReason string `json:"stop_reason"`
+		Usage      struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.NewDecoder(r).Decode(&msg); err != nil {
+		return "", usage{}, fmt.Errorf("reading response: %w", err)
+	}
+	var text strings.Builder
+	for _, c := range msg.Content {
+		if c.Type == "text" {
+			text.WriteString(c.Text)
+		}
+	}
+	u := usage{inputTokens: msg.Usage.InputTokens, outputTokens: msg.Usage.OutputTokens, stopReason: msg.StopReason}
+	return text.String(), u, nil
+}
+
+// readMessage is readStream for a non-streaming response: the reply is
+// printed, rendered the same way, once it is complete.
+func readMessage(r io.Reader, cfg config, tee io.Writer, sp *streamPrinter) (string, usage, error) {
+	text, u, err := decodeMessage(r)
+	if err != nil {
+		return "", u, err
+	}
+	if tee != nil {
+		io.WriteString(tee, text)
+	}
+	if !cfg.pager {
+		sp.write(text)
+		sp.flush()
+	}
+	if text == "" {
+		printEmpty(u)
+	}
+	return text, u, nil
+}
+
+// usage is the token accounting reported by a stream so far.
+type usage struct {
+	inputTokens  int
+	outputTokens int
+	stopReason   string
+	dropped      int // events skipped because they were not valid JSON
+}
+
+// droppedNote reports n dropped events under --strict-stream, or "".
+// Parsing itself stays lenient either way.
+func droppedNote(cfg config, n int) string {
+	if !cfg.strictStream || n == 0 {
+		return ""
+	}
+	note := fmt.Sprintf("[strict-stream: dropped %d unparseable event(s)", n)
+	if reqLog == nil {
+		return note + "; --debug-log records them]"
+	}
+	return note + "]"
+}
+
+// parseAnthropicStream reads a Messages API SSE stream. onText gets every
+// text delta, onUsage gets the running usage after message_start and
+// message_delta (and once more at the end if events were dropped as
+// unparseable), onError gets error events, and onPing gets heartbeats.
+// Callbacks may be nil.
+// It returns the first error event, or errStreamCut if the stream ended
+// without message_stop.
+func parseAnthropicStream(r io.Reader, onText func(string), onUsage func(usage), onError func(error), onPing func()) error {
+	var u usage
+	var streamErr error
+	done := false
+
+	err := readSSE(r, func(data string) bool {
+		if data == "[DONE]" {
+			done = true
+			return false
+		}
+
+		var event struct {
+			Type    string `json:"type"`
+			Message struct {
+				Usage struct {
+					InputTokens  int `json:"input_tokens"`
+					OutputTokens int `json:"output_tokens"`
+				} `json:"usage"`
+			} `json:"message"`
+			Delta struct {
+				Type       string `json:"type"`
+				Text       string `json:"text"`
+				StopReason string `json:"stop_reason"`
+			} `json:"delta"`
+			Usage struct {
+				OutputTokens int `json:"output_tokens"`
+			} `json:"usage"`
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			u.dropped++
+			reqLog.parseError(data, err)
+			return true
+		}
+
+		switch event.Type {
+		case "message_start":
+			u.inputTokens = event.Message.Usage.InputTokens
+			u.outputTokens = event.Message.Usage.OutputTokens
+			if onUsage != nil {
+				onUsage(u)
+			}
+		case "content_block_delta":
+			if event.Delta.Type == "text_delta" && onText != nil {
+				onText(event.Delta.Text)
+			}
+		case "message_delta":
+			u.outputTokens = event.Usage.OutputTokens
+			if event.Delta.StopReason != "" {
+				u.stopReason = event.Delta.StopReason
+			}
+			if onUsage != nil {
+				onUsage(u)
+			}
+		case "message_stop":
+			done = true
+		case "error":
+			e := fmt.Errorf("stream error (%s): %s", event.Error.Type, event.Error.Message)
+			if streamErr == nil {
+				streamErr = e
+			}
+			if onError != nil {
+				onError(e)
+			}
+		}
+		return true
+	}, onPing)
+	if u.dropped > 0 && onUsage != nil {
+		onUsage(u)
+	}
+
+	switch {
+	case err != nil:
+		return err
+	case streamErr != nil:
+		return streamErr
+	case !done:
+		return errStreamCut
+	}
+	return nil
+}
+
+// streamPrinter renders streamed text to stdout, a complete line at a time.
+type streamPrinter struct {
+	delay   time.Duration   // pause between words; 0 prints chunks at once
+	done    <-chan struct{} // the request's ctx.Done(); ends the pauses early
+	pending strings.Builder
+	squeeze blankSqueezer
+	gate    *pauseGate  // holds output back while paused; nil prints directly
+	words   bool        // also print unfinished lines up to their last word
+	midLine bool        // part of the current line is already printed
+	col     int         // columns of the current line already printed
+	refs    linkRefs    // links taken out of the reply so far
+	flushed time.Time   // when an unfinished line was last printed
+	idle    *time.Timer // prints the words of a line the stream stalled in
+	mu      sync.Mutex  // idle fires on a goroutine of its own
+}
+
+// wordFlushEvery debounces printing unfinished lines, so a long line shows
+// up a few words at a time rather than token by token. A stream quiet for
+// that long gets its words printed too, rather than held until more come.
+const wordFlushEvery = 80 * time.Millisecond
+
+func (sp *streamPrinter) write(text string) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if renderOpts.compact {
+		text = sp.squeeze.squeeze(text)
+	}
+	sp.pending.WriteString(text)
+	buf := sp.pending.String()
+	if i := strings.LastIndex(buf, "\n"); i >= 0 {
+		cut := i + 1
+		if open := openFence(buf[:cut]); open >= 0 {
+			cut = open // hold the code block back until it is closed
+		}
+		if cut > 0 {
+			sp.render(buf[:cut])
+			sp.pending.Reset()
+			sp.pending.WriteString(buf[cut:])
+		}
+	}
+	if !sp.words {
+		return
+	}
+	if time.Since(sp.flushed) >= wordFlushEvery {
+		sp.flushWords()
+	}
+	if sp.idle == nil {
+		sp.idle = time.AfterFunc(wordFlushEvery, func() {
+			sp.mu.Lock()
+			defer sp.mu.Unlock()
+			sp.flushWords()
+		})
+	} else {
+		sp.idle.Reset(wordFlushEvery)
+	}
+}
+
+// render prints text; if the start of its first line is already out, that
+// line gets only the inline transforms.
+func (sp *streamPrinter) render(text string) {
+	if sp.midLine {
+		rest := ""
+		if i := strings.Index(text, "\n"); i >= 0 {
+			text, rest = text[:i+1], text[i+1:]
+		}
+		sp.emit(renderInline(text, sp.col, &sp.refs))
+		text = rest
+	}
+	if text != "" {
+		sp.emit(renderMarkdown(text, &sp.refs))
+	}
+	sp.midLine = false
+}
+
+// flushWords prints the unfinished line up to its last space. It waits
+// instead while the line could still become a heading or a rule, or while a
+// bold, code span, math or link is open, since those only render whole.
+func (sp *streamPrinter) flushWords() {
+	buf := sp.pending.String()
+	if strings.Contains(buf, "\n") { // a code block being held back
+		return
+	}
+	cut := strings.LastIndex(buf, " ") + 1
+	if cut == 0 {
+		return
+	}
+	part := buf[:cut]
+	if !sp.midLine {
+		if lead := strings.TrimLeft(part, " "); lead == "" || strings.HasPrefix(lead, "#") ||
+			strings.Trim(lead, "-*_ ") == "" || strings.HasPrefix(lead, "```") {
+			return
+		}
+	}
+	if strings.Count(part, "`")%2 != 0 || strings.Count(part, "**")%2 != 0 ||
+		renderOpts.math && strings.Count(part, "$")%2 != 0 ||
+		strings.LastIndex(part, "[") > strings.LastIndex(part, ")") {
+		return
+	}
+	if sp.midLine {
+		sp.emit(renderInline(part, sp.col, &sp.refs))
+	} else {
+		sp.emit(renderMarkdown(part, &sp.refs))
+	}
+	sp.midLine = true
+	sp.flushed = time.Now()
+	sp.pending.Reset()
+	sp.pending.WriteString(buf[cut:])
+}
+
+// openFence returns the offset of the line that opens a code fence left
+// unclosed in s (whole lines), or -1 if every fence is closed.
+func openFence(s string) int {
+	open := -1
+	for off := 0; off < len(s); {
+		line, _, _ := strings.Cut(s[off:], "\n")
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			if open < 0 {
+				open = off
+			} else {
+				open = -1
+			}
+		}
+		off += len(line) + 1
+	}
+	return open
+}
+
+func (sp *streamPrinter) flush() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.idle != nil {
+		sp.idle.Stop()
+	}
+	if sp.pending.Len() > 0 {
+		sp.render(sp.pending.String())
+		sp.pending.Reset()
+	}
+}
+
+// emit prints rendered text, pacing it word by word when a delay is set.
+func (sp *streamPrinter) emit(s string) {
+	if i := strings.LastIndex(s, "\n"); i >= 0 {
+		sp.col = stringWidth(stripANSI(s[i+1:]))
+	} else {
+		sp.col += stringWidth(stripANSI(s))
+	}
+	if sp.delay <= 0 {
+		sp.gate.print(s)
+		return
+	}
+	for s != "" {
+		i := strings.IndexAny(s, " \n")
+		if i < 0 {
+			i = len(s) - 1
+		}
+		sp.gate.print(s[:i+1])
+		s = s[i+1:]
+		select {
+		case <-time.After(sp.delay):
+		case <-sp.done:
+			sp.delay = 0 // cancelled: what arrived prints at once
+			sp.gate.print(s)
+			return
+		}
+	}
+}
+
+// pauseGate lets the space bar pause a streaming chat reply. While paused,
+// output piles up (the stream keeps being read) and prints on resume.
+type pauseGate struct {
+	mu      sync.Mutex
+	paused  bool
+	held    strings.Builder
+	resumed chan struct{} // closed on resume; made anew on each pause
+}
+
+const pausedNote = "[paused — space resumes]"
+
+// print writes s to stdout, or holds it while paused. A nil gate prints.
+func (g *pauseGate) print(s string) {
+	if g == nil {
+		fmt.Print(s)
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		g.held.WriteString(s)
+		return
+	}
+	fmt.Print(s)
+}
+
+// toggle pauses or resumes, showing the paused note while paused.
+func (g *pauseGate) toggle() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		g.paused = true
+		g.resumed = make(chan struct{})
+		fmt.Printf("\033[2m%s\033[0m", pausedNote)
+		return
+	}
+	fmt.Printf("\033[%dD\033[K%s", utf8.RuneCountInString(pausedNote), g.held.String())
+	g.held.Reset()
+	g.paused = false
+	close(g.resumed)
+}
+
+// wait blocks while paused, until the reply is resumed or ctx is done. A
+// cancelled reply drops what was held and takes the paused note away.
+func (g *pauseGate) wait(ctx context.Context) {
+	g.mu.Lock()
+	paused, resumed := g.paused, g.resumed
+	g.mu.Unlock()
+	if !paused {
+		return
+	}
+	select {
+	case <-resumed:
+	case <-ctx.Done():
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.paused {
+			fmt.Printf("\033[%dD\033[K", utf8.RuneCountInString(pausedNote))
+			g.held.Reset()
+			g.paused = false
+			close(g.resumed)
+		}
+	}
+}
+
+// blankSqueezer collapses runs of blank lines to a single blank line outside
+// code fences. It keeps its state across chunks, since a run can span them.
+type blankSqueezer struct {
+	newlines int    // newlines since the last non-blank character
+	ws       string // whitespace held back until we know the line isn't dropped
+	head     string // first non-blank characters of the current line
+	fence    bool   // inside a ``` block
+}
+
+func (b *blankSqueezer) squeeze(s string) string {
+	var out strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\n':
+			if b.head == "```" {
+				b.fence = !b.fence
+			}
+			b.head = ""
+			b.newlines++
+			if b.newlines > 2 && !b.fence {
+				b.ws = ""
+				continue
+			}
+		case ' ', '\t', '\r':
+			b.ws += string(r)
+			continue
+		default:
+			b.newlines = 0
+			if len(b.head) < 3 {
+				b.head += string(r)
+			}
+		}
+		out.WriteString(b.ws)
+		b.ws = ""
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// ─── Model check ──────────────────────────────────────────────────────────────
+
+// checkedModels lists the models the run will ask: the --lineup (or default
+// lineup) for --models and --batch, the Anthropic model otherwise.
+func checkedModels(apiKey, openaiKey string, cfg config) []modelInfo {
+	if cfg.modelCompare != "" || cfg.batch != "" {
+		return comparisonModels(apiKey, openaiKey, cfg.lineup)
+	}
+	return []modelInfo{{name: cfg.model, provider: "Anthropic", apiKey: apiKey, keyEnv: "ANTHROPIC_API_KEY", model: cfg.model}}
+}
+
+// checkModels asks each provider whether its model exists (--check), which
+// also proves the provider is reachable and accepts the key. Offline modes
+// skip the check.
+func checkModels(models []modelInfo, cfg config) error {
+	if cfg.mock || cfg.dryRun {
+		return nil
+	}
+	for _, mi := range models {
+		if err := checkModel(mi, cfg); err != nil {
+			return fmt.Errorf("%s: %w", mi.name, err)
+		}
+		name := mi.name
+		if name != mi.model {
+			name += " (" + mi.model + ")"
+		}
+		fmt.Fprintf(os.Stderr, "\033[2m✓ %s\033[0m\n", name)
+	}
+	return nil
+}
+
+// checkModel looks mi's model up on its provider: the model endpoint of
+// Anthropic and Gemini, the models list of OpenAI-compatible servers.
+func checkModel(mi modelInfo, cfg config) error {
+	var req *http.Request
+	switch mi.provider {
+	case "Anthropic":
+		base := strings.TrimSuffix(anthropicMessagesURL(cfg), "/messages")
+		req, _ = http.NewRequest("GET", base+"/models/"+url.PathEscape(mi.model), nil)
+		setAnthropicHeaders(req, mi.apiKey, cfg)
+	case "Gemini":
+		req, _ = http.NewRequest("GET", mi.baseURL+"/v1beta/models/"+url.PathEscape(mi.model), nil)
+		req.Header.Set("x-goog-api-key", mi.apiKey)
+	default: // OpenAI-compatible
+		if mi.path != "" {
+			return nil // custom deployments (Azure) have no models list to check
+		}
+		req, _ = http.NewRequest("GET", mi.baseURL+"/v1/models", nil)
+		mi.setAuth(req)
+	}
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+
+	resp, err := cfg.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := decodeBody(resp); err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		return &apiError{resp.StatusCode, string(b), mi.keyEnv}
+	}
+	if mi.provider == "Anthropic" || mi.provider == "Gemini" {
+		return nil
+	}
+
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return fmt.Errorf("models list: %w", err)
+	}
+	var ids []string
+	for _, m := range list.Data {
+		if m.ID == mi.model {
+			return nil
+		}
+		ids = append(ids, m.ID)
+	}
+	return fmt.Errorf("model %q not found (available: %s)", mi.model, truncate(strings.Join(ids, ", "), 200))
+}
+
+// ─── Redaction ────────────────────────────────────────────────────────────────
+
+var (
+	secrets     []string
+	reSKKey     = regexp.MustCompile(`sk-[A-Za-z0-9_-]{8,}`)
+	reKeyHeader = regexp.MustCompile(`(?i)((?:x-api-key|authorization)["']?\s*[:=]\s*["']?(?:bearer\s+)?)[^\s"']+`)
+)
+
+// addSecret registers a loaded API key so redact can mask it verbatim.
+func addSecret(key string) {
+	if key != "" {
+		secrets = append(secrets, key)
+	}
+}
+
+// redact masks loaded API keys and anything that looks like one.
+func redact(s string) string {
+	for _, k := range secrets {
+		s = strings.ReplaceAll(s, k, "***")
+	}
+	s = reKeyHeader.ReplaceAllString(s, "${1}***")
+	return reSKKey.ReplaceAllString(s, "***")
+}
+
+// ─── Debug log ────────────────────────────────────────────────────────────────
+
+// reqLog is the --debug-log file, nil when logging is off.
+var reqLog *jsonlLog
+
+// jsonlLog appends one JSON object per line. Methods on a nil log do nothing.
+type jsonlLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	reqs int // requests logged so far; numbers them
+}
+
+func (l *jsonlLog) write(rec map[string]any) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rec["time"] = time.Now().Format(time.RFC3339Nano)
+	line, _ := json.Marshal(rec)
+	l.f.Write(append(line, '\n'))
+}
+
+func (l *jsonlLog) nextID() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reqs++
+	return l.reqs
+}
+
+// parseError records an SSE event that a stream parser skipped because it
+// was not valid JSON.
+func (l *jsonlLog) parseError(data string, err error) {
+	l.write(map[string]any{"kind": "parse_error", "data": data, "error": err.Error()})
+}
+
+// loggingDoer records each request, its response status and every line of
+// the response body in reqLog, timed from when the request was sent.
+type loggingDoer struct {
+	next doer
+}
+
+func (d loggingDoer) Do(req *http.Request) (*http.Response, error) {
+	id := reqLog.nextID()
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	headers := map[string]string{}
+	for name := range req.Header {
+		value := req.Header.Get(name)
+		if isSecretHeader(name) {
+			value = maskKey(value)
+		}
+		headers[name] = value
+	}
+	var logged any = redact(string(body))
+	if json.Valid([]byte(logged.(string))) {
+		logged = json.RawMessage(logged.(string))
+	}
+	reqLog.write(map[string]any{"kind": "request", "id": id, "method": req.Method,
+		"url": redact(req.URL.String()), "headers": headers, "body": logged})
+
+	start := time.Now()
+	resp, err := d.next.Do(req)
+	if err != nil {
+		reqLog.write(map[string]any{"kind": "error", "id": id, "ms": time.Since(start).Milliseconds(), "error": redact(err.Error())})
+		return nil, err
+	}
+	// Log the decoded stream; the callers' decodeBody then has nothing to do.
+	if err := decodeBody(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	resp.Header.Del("Content-Encoding")
+	reqLog.write(map[string]any{"kind": "response", "id": id, "ms": time.Since(start).Milliseconds(),
+		"status": resp.StatusCode, "contentType": resp.Header.Get("Content-Type")})
+	resp.Body = &loggedBody{ReadCloser: resp.Body, id: id, start: start}
+	return resp, nil
+}
+
+// loggedBody logs each complete line read through it.
+type loggedBody struct {
+	io.ReadCloser
+	id      int
+	start   time.Time
+	partial []byte
+	size    int
+	ended   bool
+}
+
+func (b *loggedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += n
+	b.partial = append(b.partial, p[:n]...)
+	for {
+		i := bytes.IndexByte(b.partial, '\n')
+		if i < 0 {
+			break
+		}
+		b.line(string(b.partial[:i]))
+		b.partial = b.partial[i+1:]
+	}
+	if err != nil {
+		b.end(err)
+	}
+	return n, err
+}
+
+func (b *loggedBody) line(s string) {
+	if s = strings.TrimRight(s, "\r"); s != "" {
+		reqLog.write(map[string]any{"kind": "event", "id": b.id, "ms": time.Since(b.start).Milliseconds(), "line": s})
+	}
+}
+
+func (b *loggedBody) end(err error) {
+	if b.ended {
+		return
+	}
+	b.ended = true
+	b.line(string(b.partial))
+	rec := map[string]any{"kind": "end", "id": b.id, "ms": time.Since(b.start).Milliseconds(), "bytes": b.size}
+	if err != io.EOF {
+		rec["error"] = redact(err.Error())
+	}
+	reqLog.write(rec)
+}
+
+func (b *loggedBody) Close() error {
+	b.end(errors.New("closed before the end of the body"))
+	return b.ReadCloser.Close()
+}
+
+// ─── Mock server ─────────────────────────────────────────────────────────────
+
+// mockDoer answers every request with a canned SSE stream in the format of
+// the provider it was meant for. The text and its length depend only on the
+// request body, so each panel gets its own answer and runs are repeatable.
+type mockDoer struct{}
+
+var mockWords = strings.Fields(`the model streams a canned answer so the split screen
+	can be exercised offline each panel gets text of its own length which is
+	enough to wrap long lines scroll the panel and fill the status counters
+	nothing here comes from a real API and no key is needed`)
+
+func (mockDoer) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+	}
+	h := fnv.New32a()
+	h.Write(body)
+	seed := h.Sum32()
+
+	var chunks []string
+	n := 20 + int(seed%160)
+	for i := range n {
+		seed = seed*1664525 + 1013904223
+		word := mockWords[seed>>8%uint32(len(mockWords))]
+		switch {
+		case i == 0:
+			word = "**Mock** " + word
+		case seed%23 == 0:
+			word = "\n\n" + word
+		case seed%17 == 0:
+			word = "\n- " + word
+		default:
+			word = " " + word
+		}
+		chunks = append(chunks, word)
+	}
+
+	return sseResponse(req, mockEvents(req.URL.Path, chunks), 30*time.Millisecond), nil
+}
+
+// dryRunDoer sends nothing: each request is answered with itself, method,
+// URL, headers and pretty JSON body, with keys redacted (--dry-run).
+type dryRunDoer struct{}
+
+func (dryRunDoer) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+	}
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, body, "", "  ") != nil {
+		pretty.Write(body)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[dry run] %s %s\n", req.Method, req.URL)
+	for _, name := range slices.Sorted(maps.Keys(req.Header)) {
+		value := req.Header.Get(name)
+		if isSecretHeader(name) {
+			value = maskKey(value)
+		}
+		fmt.Fprintf(&b, "%s: %s\n", name, value)
+	}
+	fmt.Fprintf(&b, "\n```json\n%s\n```\n", pretty.String())
+
+	// One chunk per line, so panels fill the way they do with real replies.
+	chunks := strings.SplitAfter(redact(b.String()), "\n")
+	return sseResponse(req, mockEvents(req.URL.Path, chunks), 0), nil
+}
+
+// sseResponse streams events as SSE data lines, pace apart, until the
+// request is cancelled.
+func sseResponse(req *http.Request, events []string, pace time.Duration) *http.Response {
+	pr, pw := io.Pipe()
+	go func() {
+		for _, e := range events {
+			select {
+			case <-req.Context().Done():
+				pw.CloseWithError(req.Context().Err())
+				return
+			case <-time.After(pace):
+			}
+			fmt.Fprintf(pw, "data: %s\n\n", e)
+		}
+		pw.Close()
+	}()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/event-stream"}},
+		Body:       pr,
+		Request:    req,
+	}
+}
+
+// mockEvents renders the text chunks as one provider's SSE data payloads,
+// with fake usage (one token per chunk).
+func mockEvents(path string, chunks []string) []string {
+	j := func(v any) string {
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	var events []string
+	switch {
+	case strings.HasSuffix(path, "/messages"):
+		events = append(events, j(map[string]any{"type": "message_start", "message": map[string]any{"usage": map[string]int{"input_tokens": 42, "output_tokens": 1}}}))
+		for _, c := range chunks {
+			events = append(events, j(map[string]any{"type": "content_block_delta", "delta": map[string]string{"type": "text_delta", "text": c}}))
+		}
+		events = append(events,
+			j(map[string]any{"type": "message_delta", "delta": map[string]string{"stop_reason": "end_turn"}, "usage": map[string]int{"output_tokens": len(chunks)}}),
+			j(map[string]string{"type": "message_stop"}))
+	case strings.Contains(path, ":streamGenerateContent"):
+		for i, c := range chunks {
+			cand := map[string]any{"content": map[string]any{"role": "model", "parts": []map[string]string{{"text": c}}}}
+			if i == len(chunks)-1 {
+				cand["finishReason"] = "STOP"
+			}
+			events = append(events, j(map[string]any{"candidates": []any{cand}, "usageMetadata": map[string]int{"promptTokenCount": 42, "candidatesTokenCount": i + 1}}))
+		}
+	default: // OpenAI-compatible
+		for _, c := range chunks {
+			events = append(events, j(map[string]any{"choices": []any{map[string]any{"delta": map[string]string{"content": c}}}}))
+		}
+		events = append(events,
+			j(map[string]any{"choices": []any{}, "usage": map[string]int{"prompt_tokens": 42, "completion_tokens": len(chunks)}}),
+			"[DONE]")
+	}
+	return events
+}
+
+// ─── Env ──────────────────────────────────────────────────────────────────────
 
 func loadEnv(path, key string) string {
+	return loadEnvAll(path)[key]
+}
+
+// loadEnvAll reads every KEY=value line of an env file; a missing file is empty.
+func loadEnvAll(path string) map[string]string {
+	vars := map[string]string{}
 	f, err := os.Open(path)
 	if err != nil {
-		return ""
+		return vars
 	}
 	defer f.Close()
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
-		if k, v, ok := strings.Cut(line, "="); ok && strings.TrimSpace(k) == key {
-			return strings.TrimSpace(v)
+		if k, v, ok := strings.Cut(line, "="); ok {
+			if k = strings.TrimSpace(k); vars[k] == "" {
+				vars[k] = strings.TrimSpace(v)
+			}
 		}
 	}
-	return ""
+	return vars
+}
+
+// getenv looks key up in .env first, then in the process environment, so
+// existing shell setups (OPENAI_API_KEY=… in the profile) work as is.
+func getenv(key string) string {
+	if v := loadEnv(".env", key); v != "" {
+		return v
+	}
+	return os.Getenv(key)
+}
+
+// baseURLFromEnv is the base URL set in env var key, or fallback. A trailing
+// /v1 is dropped since request paths add it (OPENAI_BASE_URL usually has it).
+func baseURLFromEnv(key, fallback string) string {
+	v := strings.TrimRight(getenv(key), "/")
+	if v == "" {
+		return fallback
+	}
+	return strings.TrimSuffix(v, "/v1")
 }
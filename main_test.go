@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// doerFunc adapts a function to the doer interface.
+type doerFunc func(*http.Request) (*http.Response, error)
+
+func (f doerFunc) Do(req *http.Request) (*http.Response, error) { return f(req) }
+
+// testConfig is a chat config that sends through client and prints nothing.
+func testConfig(client doer) config {
+	return config{model: "claude-sonnet-4-5-20250929", maxTokens: 100, temperature: -1, client: client, pager: true}
+}
+
+func TestChatTurn(t *testing.T) {
+	user := []message{{Role: "user", Content: "hi"}}
+	status := func(code int, body string) doer {
+		return doerFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: code, Body: io.NopCloser(strings.NewReader(body)), Header: http.Header{}, Request: req}, nil
+		})
+	}
+	empty := doerFunc(func(req *http.Request) (*http.Response, error) {
+		return sseResponse(req, mockEvents(req.URL.Path, nil), 0), nil
+	})
+	tests := []struct {
+		name      string
+		client    doer
+		cancel    time.Duration // cancel the request after this long; 0 never
+		wantLen   int
+		cancelled bool
+		err       bool
+	}{
+		{name: "success", client: mockDoer{}, wantLen: 2},
+		{name: "cancel", client: mockDoer{}, cancel: 50 * time.Millisecond, wantLen: 0, cancelled: true},
+		{name: "error", client: status(400, `{"error":{"message":"bad"}}`), wantLen: 0, err: true},
+		{name: "empty reply", client: empty, wantLen: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.cancel > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.cancel)
+				defer cancel()
+			}
+			history, res := chatTurn(ctx, "key", testConfig(tt.client), append([]message(nil), user...))
+			if len(history) != tt.wantLen {
+				t.Errorf("history has %d messages, want %d: %+v", len(history), tt.wantLen, history)
+			}
+			if res.cancelled != tt.cancelled {
+				t.Errorf("cancelled = %v, want %v", res.cancelled, tt.cancelled)
+			}
+			if (res.err != nil) != tt.err && !tt.cancelled {
+				t.Errorf("err = %v, want error: %v", res.err, tt.err)
+			}
+			if tt.wantLen == 2 && (history[1].Role != "assistant" || history[1].Content != res.reply || res.reply == "") {
+				t.Errorf("last message = %+v, want the reply %q", history[1], res.reply)
+			}
+		})
+	}
+}
+
+func TestBuildOpenAIRequest(t *testing.T) {
+	tests := []struct {
+		model       string
+		stop        string
+		temperature float64
+		want        map[string]any // keys that must be present, with their JSON values
+		absent      []string
+	}{
+		{model: "gpt-4o", stop: "END", temperature: 0.5,
+			want:   map[string]any{"stop": []any{"END"}, "max_tokens": 100.0, "temperature": 0.5},
+			absent: []string{"max_completion_tokens"}},
+		{model: "gpt-4o-mini", temperature: -1,
+			want:   map[string]any{"max_tokens": 100.0},
+			absent: []string{"stop", "temperature", "max_completion_tokens"}},
+		{model: "o3-mini", temperature: 0.5,
+			want:   map[string]any{"max_completion_tokens": 100.0},
+			absent: []string{"max_tokens", "temperature"}},
+		{model: "gpt-5", stop: "X", temperature: 1,
+			want:   map[string]any{"stop": []any{"X"}, "max_completion_tokens": 100.0},
+			absent: []string{"max_tokens", "temperature"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			cfg := config{maxTokens: 100, temperature: tt.temperature, stop: tt.stop}
+			data, err := json.Marshal(buildOpenAIRequest(tt.model, cfg, []message{{Role: "user", Content: "hi"}}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body map[string]any
+			json.Unmarshal(data, &body)
+			for k, v := range tt.want {
+				if !reflect.DeepEqual(body[k], v) {
+					t.Errorf("%s = %v, want %v", k, body[k], v)
+				}
+			}
+			for _, k := range tt.absent {
+				if v, ok := body[k]; ok {
+					t.Errorf("%s = %v, want it left out", k, v)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAnthropicStream(t *testing.T) {
+	const (
+		start = `data: {"type":"message_start","message":{"usage":{"input_tokens":12,"output_tokens":1}}}` + "\n\n"
+		hello = `data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"Hel"}}` + "\n\n" +
+			`data: {"type":"content_block_delta","delta":{"type":"text_delta","text":"lo"}}` + "\n\n"
+		end  = `data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":5}}` + "\n\n"
+		stop = `data: {"type":"message_stop"}` + "\n\n"
+	)
+	tests := []struct {
+		name    string
+		stream  string
+		text    string
+		usage   usage
+		errors  int // error events passed to onError
+		pings   int
+		wantErr error // nil, errStreamCut or errAny
+	}{
+		{name: "complete", stream: start + hello + end + stop, text: "Hello",
+			usage: usage{inputTokens: 12, outputTokens: 5, stopReason: "end_turn"}},
+		{name: "done marker", stream: start + hello + "data: [DONE]\n\n", text: "Hello",
+			usage: usage{inputTokens: 12, outputTokens: 1}},
+		{name: "cut off", stream: start + hello, text: "Hello",
+			usage: usage{inputTokens: 12, outputTokens: 1}, wantErr: errStreamCut},
+		{name: "error event", stream: start + hello + `data: {"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}` + "\n\n",
+			text: "Hello", usage: usage{inputTokens: 12, outputTokens: 1}, errors: 1, wantErr: errAny},
+		{name: "pings and other deltas", stream: ": keepalive\n\nevent: ping\ndata: {\"type\":\"ping\"}\n\n" + start +
+			`data: {"type":"content_block_delta","delta":{"type":"input_json_delta","partial_json":"{}"}}` + "\n\n" + hello + end + stop,
+			text: "Hello", usage: usage{inputTokens: 12, outputTokens: 5, stopReason: "end_turn"}, pings: 2},
+		{name: "malformed event", stream: start + "data: {not json\n\n" + hello + end + stop, text: "Hello",
+			usage: usage{inputTokens: 12, outputTokens: 5, stopReason: "end_turn", dropped: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var text strings.Builder
+			var got usage
+			events, pings := 0, 0
+			err := parseAnthropicStream(strings.NewReader(tt.stream),
+				func(s string) { text.WriteString(s) },
+				func(u usage) { got = u },
+				func(error) { events++ },
+				func() { pings++ })
+			if text.String() != tt.text {
+				t.Errorf("text = %q, want %q", text.String(), tt.text)
+			}
+			if got != tt.usage {
+				t.Errorf("usage = %+v, want %+v", got, tt.usage)
+			}
+			if events != tt.errors || pings != tt.pings {
+				t.Errorf("%d error events and %d pings, want %d and %d", events, pings, tt.errors, tt.pings)
+			}
+			if tt.wantErr == errAny && err == nil || tt.wantErr != errAny && err != tt.wantErr {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// errAny in a test table accepts any non-nil error.
+var errAny = errors.New("any error")
+
+func TestPauseGateCancelClearsNote(t *testing.T) {
+	g := &pauseGate{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	out := captureStdout(t, func() {
+		g.toggle()
+		g.print("held")
+		g.wait(ctx)
+		g.print("after")
+	})
+	if strings.Contains(out, "held") {
+		t.Errorf("cancelled reply printed its held text: %q", out)
+	}
+	if !strings.HasSuffix(out, "\033[K"+"after") {
+		t.Errorf("paused note not cleared before later output: %q", out)
+	}
+}
+
+func TestSpendLog(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	a, b := newSpendLog(config{}), newSpendLog(config{})
+	if a.id() == b.id() {
+		t.Errorf("two runs share session id %q", a.id())
+	}
+	if l := newSpendLog(config{mock: true}); l != nil {
+		t.Errorf("mock run got a spend log")
+	}
+
+	a.add("claude-sonnet-4-5-20250929", usage{inputTokens: 1000, outputTokens: 100})
+	a.add("no-such-model", usage{inputTokens: 1000, outputTokens: 100})
+	a.addMetrics(&metrics{model: "groq:llama-3.1-8b", inputTokens: 10, outputTokens: 10, costIn: 0.05, costOut: 0.08})
+	var none *spendLog
+	none.add("claude-sonnet-4-5-20250929", usage{inputTokens: 1})
+
+	entries, err := loadSpend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var models []string
+	for _, e := range entries {
+		if e.Session != a.id() {
+			t.Errorf("entry for %s in session %q, want %q", e.Model, e.Session, a.id())
+		}
+		models = append(models, e.Model)
+	}
+	want := []string{"claude-sonnet-4-5-20250929", "groq:llama-3.1-8b"}
+	if !reflect.DeepEqual(models, want) {
+		t.Errorf("recorded %v, want %v", models, want)
+	}
+}
+
+func TestSuggestFollowUps(t *testing.T) {
+	history := []message{{Role: "user", Content: "hi"}, {Role: "assistant", Content: "hello"}}
+	reply := doerFunc(func(req *http.Request) (*http.Response, error) {
+		return sseResponse(req, mockEvents(req.URL.Path, []string{"1. Why?\n", "2. How?\n", "3. When?"}), 0), nil
+	})
+	got, u := suggestFollowUps(context.Background(), "key", testConfig(reply), history)
+	if want := []string{"Why?", "How?", "When?"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("suggestions = %q, want %q", got, want)
+	}
+	if u.inputTokens+u.outputTokens == 0 {
+		t.Errorf("usage not reported: %+v", u)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got, _ := suggestFollowUps(ctx, "key", testConfig(mockDoer{}), history); got != nil {
+		t.Errorf("cancelled request gave suggestions %q", got)
+	}
+}
+
+func TestCompleteKeepsWholeRunes(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, name := range []string{"файл.txt", "фото.txt"} {
+		if err := os.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := &lineEditor{}
+	var got []rune
+	captureStdout(t, func() { got = e.complete("You: ", []rune("/system-file ")) })
+	if want := "/system-file ф"; string(got) != want {
+		t.Errorf("completed to %q, want %q", string(got), want)
+	}
+}
+
+func TestIsSecretHeader(t *testing.T) {
+	for name, want := range map[string]bool{
+		"X-Api-Key": true, "Authorization": true, "api-key": true, "X-Goog-Api-Key": true,
+		"Content-Type": false, "Anthropic-Version": false,
+	} {
+		if got := isSecretHeader(name); got != want {
+			t.Errorf("isSecretHeader(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestClassifyAPIErrorAuth(t *testing.T) {
+	got := classifyAPIError(401, `{"error":{"message":"invalid x-api-key"}}`, "OPENAI_API_KEY")
+	if want := "Authentication failed (401) — check OPENAI_API_KEY in .env or the environment"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// runScript feeds script to runChat as piped input and returns the request
+// bodies sent and what it printed, along with runChat's error. Requests go to cfg.client when it
+// is set and are otherwise answered with reply.
+func runScript(t *testing.T, cfg config, script string, reply ...string) ([]string, string, error) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir()) // keep the last-run file out of the real home
+	saved := stdin
+	stdin = bufio.NewReader(strings.NewReader(script))
+	defer func() { stdin = saved }()
+	var bodies []string
+	client := cfg.client
+	cfg.client = doerFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := io.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		if client != nil {
+			return client.Do(req)
+		}
+		return sseResponse(req, mockEvents(req.URL.Path, reply), 0), nil
+	})
+	var err error
+	out := captureStdout(t, func() { err = runChat("key", "", cfg, "") })
+	return bodies, out, err
+}
+
+func TestCompactSummaryFollowsHistory(t *testing.T) {
+	const summary = "Summary of the earlier conversation"
+	tests := []struct {
+		name   string
+		script string
+		want   bool // the last request carries the summary
+	}{
+		{"compacted", "one\ntwo\n/compact\nthree\n", true},
+		{"cleared", "one\ntwo\n/compact\n/clear!\nthree\n", false},
+		{"undo clear", "one\ntwo\n/compact\n/clear!\n/undo-clear\nthree\n", true},
+		{"other branch", "one\n/branch b\ntwo\nthree\n/compact\n/switch main\nfour\n", false},
+		{"back on branch", "one\n/branch b\ntwo\nthree\n/compact\n/switch main\n/switch b\nfour\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bodies, _, err := runScript(t, testConfig(nil), tt.script, "noted")
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := bodies[len(bodies)-1]
+			if got := strings.Contains(last, summary); got != tt.want {
+				t.Errorf("last request has the summary = %v, want %v: %s", got, tt.want, last)
+			}
+		})
+	}
+}
+
+func TestSummarizeOldFollowsHistory(t *testing.T) {
+	cfg := testConfig(nil)
+	cfg.contextLimit, cfg.summarizeOld = 1, true
+	for script, want := range map[string]bool{
+		"one\ntwo\nthree\n":          true,
+		"one\ntwo\n/clear!\nthree\n": false,
+	} {
+		bodies, _, err := runScript(t, cfg, script, "noted")
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := bodies[len(bodies)-1]
+		if got := strings.Contains(last, "Summary of the earlier conversation"); got != want {
+			t.Errorf("%q: last request has the summary = %v, want %v: %s", script, got, want, last)
+		}
+	}
+}
+
+func TestFlagUsageHidesFlags(t *testing.T) {
+	fs := flag.NewFlagSet("app", flag.ContinueOnError)
+	fs.Bool("mock", false, "canned replies")
+	fs.Int("tabstop", 4, "tab width")
+	var b strings.Builder
+	fs.SetOutput(&b)
+	fs.Parse([]string{"-tabstop", "8"})
+	flagUsage(fs, "mock")()
+	if got := b.String(); strings.Contains(got, "mock") || !strings.Contains(got, "tab width (default 4)") {
+		t.Errorf("usage:\n%s", got)
+	}
+}
+
+func TestChatExitsOnLastTurn(t *testing.T) {
+	calls := 0
+	failFirst := doerFunc(func(req *http.Request) (*http.Response, error) {
+		if calls++; calls == 1 {
+			return &http.Response{StatusCode: 400, Body: io.NopCloser(strings.NewReader(`{"error":{"message":"bad"}}`)), Header: http.Header{}, Request: req}, nil
+		}
+		return sseResponse(req, mockEvents(req.URL.Path, []string{"ok"}), 0), nil
+	})
+	if _, _, err := runScript(t, testConfig(failFirst), "one\ntwo\n"); err != nil {
+		t.Errorf("a session that recovered returned %v", err)
+	}
+	calls = 0
+	if _, _, err := runScript(t, testConfig(failFirst), "one\n"); err == nil {
+		t.Error("a session that ended on a failed turn returned no error")
+	}
+}
+
+func TestChatPromptShowsModel(t *testing.T) {
+	cfg := testConfig(nil)
+	cfg.userLabel = "You"
+	_, out, err := runScript(t, cfg, "one\n/use haiku\ntwo\n", "ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"You [sonnet]: ", "You [haiku]: "} {
+		if !strings.Contains(out, want) {
+			t.Errorf("no prompt %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestBareSystemPlusIsNotSent(t *testing.T) {
+	bodies, out, err := runScript(t, testConfig(nil), "/system+\n", "ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 0 || !strings.Contains(out, "Usage: /system+") {
+		t.Errorf("sent %d requests; printed:\n%s", len(bodies), out)
+	}
+}
+
+func TestLoadSchemaRejectsBadPattern(t *testing.T) {
+	path := t.TempDir() + "/schema.json"
+	for body, wantErr := range map[string]bool{
+		`{"properties":{"tags":{"items":{"pattern":"^[a-z"}}}}`:    true,
+		`{"properties":{"tags":{"items":{"pattern":"^[a-z]+$"}}}}`: false,
+	} {
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadSchema(path)
+		if (err != nil) != wantErr || wantErr && !strings.Contains(err.Error(), "$.tags[]") {
+			t.Errorf("%s: err = %v, want error %v", body, err, wantErr)
+		}
+	}
+}
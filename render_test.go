@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the testdata .golden files from the current output")
+
+// withRender fixes the theme and render options for the duration of a test,
+// so output doesn't depend on the terminal or on flags.
+func withRender(t *testing.T, opts renderOptions) {
+	t.Helper()
+	theme, saved := activeTheme, renderOpts
+	activeTheme = themes["default"].resolve(color16)
+	renderOpts = opts
+	t.Cleanup(func() { activeTheme, renderOpts = theme, saved })
+}
+
+// TestRenderGolden runs each testdata/*.md through renderMarkdown and
+// compares the result with the matching .golden file. go test -update
+// rewrites the golden files.
+func TestRenderGolden(t *testing.T) {
+	withRender(t, renderOptions{tabStop: 4})
+	inputs, err := filepath.Glob("testdata/*.md")
+	if err != nil || len(inputs) == 0 {
+		t.Fatalf("no fixtures in testdata: %v", err)
+	}
+	for _, in := range inputs {
+		name := strings.TrimSuffix(filepath.Base(in), ".md")
+		t.Run(name, func(t *testing.T) {
+			src, err := os.ReadFile(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := renderMarkdown(string(src), nil)
+			golden := strings.TrimSuffix(in, ".md") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if got != string(want) {
+				t.Errorf("%s differs from %s:\n got: %q\nwant: %q", in, golden, got, want)
+			}
+		})
+	}
+}
+
+func TestRenderCodeBlockLanguage(t *testing.T) {
+	withRender(t, renderOptions{tabStop: 4})
+	tagged := renderMarkdown("```go\nx := 1\n```", nil)
+	plain := renderMarkdown("```\nx := 1\n```", nil)
+	if tagged == plain {
+		t.Fatalf("a go block renders the same as an untagged one: %q", tagged)
+	}
+	if !strings.Contains(tagged, "go") || strings.Contains(plain, "go") {
+		t.Errorf("tagged = %q, plain = %q; want the go label only on the tagged block", tagged, plain)
+	}
+
+	activeTheme = themes["monochrome"].resolve(colorNone)
+	if got, want := renderMarkdown("```go\nx := 1\n```", nil), "go\nx := 1\n"; got != want {
+		t.Errorf("monochrome = %q, want %q with no escape sequences", got, want)
+	}
+}
+
+func TestStreamPrinterTabsMidLine(t *testing.T) {
+	withRender(t, renderOptions{tabStop: 4})
+	out := captureStdout(t, func() {
+		sp := &streamPrinter{words: true}
+		sp.write("ab ") // printed at once, as words
+		sp.write("\tc\n")
+	})
+	if want := "ab  c\n"; out != want {
+		t.Errorf("got %q, want %q (the tab stops at column 4 of the line)", out, want)
+	}
+}
+
+func TestExpandTabsUnsetStop(t *testing.T) {
+	if got, want := expandTabs("a\tb", 0, 0), "a   b"; got != want {
+		t.Errorf("stop 0: got %q, want %q", got, want)
+	}
+}
+
+func TestStreamPrinterDelayStopsOnCancel(t *testing.T) {
+	withRender(t, renderOptions{tabStop: 4})
+	done := make(chan struct{})
+	close(done)
+	out := captureStdout(t, func() {
+		sp := &streamPrinter{delay: time.Hour, done: done}
+		sp.write("one two three\n")
+	})
+	if want := "one two three\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestLinkRefsPerReply(t *testing.T) {
+	withRender(t, renderOptions{tabStop: 4, linkRefs: true})
+	reply := "See [docs](https://a.example) and `[x](https://code.example)`.\nAlso [b](https://b.example), [docs](https://a.example).\n"
+	sp := &streamPrinter{}
+	out := captureStdout(t, func() {
+		for chunk := range strings.SplitSeq(reply, " ") {
+			sp.write(chunk + " ")
+		}
+		sp.flush()
+	})
+	if !strings.Contains(out, "docs[1]") || !strings.Contains(out, "b[2]") || strings.Contains(out, "docs[3]") {
+		t.Errorf("links numbered wrong: %q", out)
+	}
+	if got, want := linkNotes(reply), sp.refs.notes(); got != want || !strings.Contains(got, "[2] https://b.example") {
+		t.Errorf("linkNotes = %q, printer collected %q", got, want)
+	}
+
+	var refs linkRefs
+	renderMarkdown("[c](https://c.example)\n", &refs)
+	if len(refs.urls) != 1 {
+		t.Errorf("a fresh render collected %v, want only its own link", refs.urls)
+	}
+}
+
+func TestStreamPrinterWordsAfterStall(t *testing.T) {
+	withRender(t, renderOptions{tabStop: 4})
+	var stalled string
+	out := captureStdout(t, func() {
+		sp := &streamPrinter{words: true}
+		sp.write("one two")
+		sp.write(" three fo") // too soon after the last flush to print
+		time.Sleep(3 * wordFlushEvery)
+		sp.mu.Lock()
+		stalled = sp.pending.String()
+		sp.mu.Unlock()
+		sp.write("ur\n")
+		sp.flush()
+	})
+	if stalled != "fo" {
+		t.Errorf("held %q after the stream stalled, want only the unfinished word", stalled)
+	}
+	if want := "one two three four\n"; out != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}